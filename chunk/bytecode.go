@@ -0,0 +1,286 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// A .loxc file is the magic string, the format version, the opcode table
+// hash as four little-endian bytes and then the top-level function. Other
+// integers are unsigned varints. A function is
+//
+//	name, arity, upvalue count
+//	code length, code bytes
+//	position run count, (offset, line, column) per run
+//	constant count, constants
+//
+// where each constant is a tag byte followed by nothing for nil, one byte
+// for a bool, eight little-endian bytes for a number, a string, or a nested
+// function. Strings are a length followed by their bytes.
+const (
+	BYTECODE_MAGIC   = "\x7fLOXC"
+	BYTECODE_VERSION = 1
+
+	// MAX_FUNCTION_DEPTH bounds how deeply functions may be nested in a file,
+	// so hostile input cannot exhaust the Go stack while loading.
+	MAX_FUNCTION_DEPTH = 256
+)
+
+const (
+	TAG_NIL byte = iota
+	TAG_FALSE
+	TAG_TRUE
+	TAG_NUMBER
+	TAG_STRING
+	TAG_FUNCTION
+)
+
+// DecodeError is returned for bytecode that is malformed or was written by
+// an incompatible build. Offset is the byte offset into the file where
+// decoding stopped.
+type DecodeError struct {
+	Offset  int
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid bytecode at byte %d: %s", e.Offset, e.Message)
+}
+
+// OpcodeTableHash identifies the instruction set of this build.
+func OpcodeTableHash() uint32 {
+	return hashString(strings.Join(opNames[:], "\n"))
+}
+
+// IsBytecode reports whether data starts like a serialized function.
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BYTECODE_MAGIC))
+}
+
+// Encode serializes function and every function nested in its constants.
+func Encode(function *ObjFunction) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(BYTECODE_MAGIC)
+	writeUvarint(&buf, BYTECODE_VERSION)
+	var hash [4]byte
+	binary.LittleEndian.PutUint32(hash[:], OpcodeTableHash())
+	buf.Write(hash[:])
+
+	if err := encodeFunction(&buf, function); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeFunction(buf *bytes.Buffer, function *ObjFunction) error {
+	writeString(buf, function.Name)
+	writeUvarint(buf, uint64(function.Arity))
+	writeUvarint(buf, uint64(function.UpvalueCount))
+
+	ck := &function.Ck
+	writeUvarint(buf, uint64(len(ck.Codes)))
+	buf.Write(ck.Codes)
+
+	writeUvarint(buf, uint64(len(ck.Positions)))
+	for _, run := range ck.Positions {
+		writeUvarint(buf, uint64(run.Offset))
+		writeUvarint(buf, uint64(run.Line))
+		writeUvarint(buf, uint64(run.Column))
+	}
+
+	writeUvarint(buf, uint64(len(ck.Constants)))
+	for _, constant := range ck.Constants {
+		switch {
+		case constant.IsNil():
+			buf.WriteByte(TAG_NIL)
+		case constant.IsBool():
+			if constant.AsBool() {
+				buf.WriteByte(TAG_TRUE)
+			} else {
+				buf.WriteByte(TAG_FALSE)
+			}
+		case constant.IsNumber():
+			buf.WriteByte(TAG_NUMBER)
+			var num [8]byte
+			binary.LittleEndian.PutUint64(num[:], math.Float64bits(constant.AsNumber()))
+			buf.Write(num[:])
+		case constant.IsString():
+			buf.WriteByte(TAG_STRING)
+			writeString(buf, constant.AsString().Chars)
+		case constant.IsObject() && constant.AsObject().IsFunction():
+			buf.WriteByte(TAG_FUNCTION)
+			if err := encodeFunction(buf, constant.AsObject().AsFunction()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot serialize constant %s in %s", constant, function.GetName())
+		}
+	}
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	buf.Write(tmp[:n])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// Decode loads a function serialized by Encode, allocating its strings and
+// functions in hp, and checks the result with Verify. Like a freshly
+// compiled script, the result is not rooted; the caller must make it
+// reachable before allocating again.
+func Decode(data []byte, hp *Heap) (function *ObjFunction, err error) {
+	d := &decoder{data: data, hp: hp}
+	hp.PushRoots(d.markRoots)
+	defer hp.PopRoots()
+	defer func() {
+		if r := recover(); r != nil {
+			switch fault := r.(type) {
+			case *DecodeError:
+				err = fault
+			case OutOfMemory:
+				err = fault
+			default:
+				panic(r)
+			}
+			function = nil
+		}
+	}()
+
+	if !IsBytecode(data) {
+		d.fail("not a glox bytecode file")
+	}
+	d.pos = len(BYTECODE_MAGIC)
+	if version := d.uvarint(); version != BYTECODE_VERSION {
+		d.fail("unsupported format version %d, expected %d", version, BYTECODE_VERSION)
+	}
+	hash := binary.LittleEndian.Uint32(d.bytes(4))
+	if hash != OpcodeTableHash() {
+		d.fail("written for a different instruction set")
+	}
+
+	function = d.function()
+	if d.pos != len(d.data) {
+		d.fail("unexpected data after the script")
+	}
+	if err := Verify(function); err != nil {
+		return nil, err
+	}
+	return function, nil
+}
+
+type decoder struct {
+	data []byte
+	pos  int
+	hp   *Heap
+	// functions are those being decoded, whose constants are not yet
+	// reachable from anything else.
+	functions []*ObjFunction
+}
+
+func (d *decoder) markRoots(hp *Heap) {
+	for _, function := range d.functions {
+		hp.MarkConstants(function)
+	}
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	panic(&DecodeError{Offset: d.pos, Message: fmt.Sprintf(format, a...)})
+}
+
+func (d *decoder) function() *ObjFunction {
+	if len(d.functions) == MAX_FUNCTION_DEPTH {
+		d.fail("functions nested too deeply")
+	}
+	function := &ObjFunction{}
+	d.functions = append(d.functions, function)
+
+	function.Name = d.string()
+	function.Arity = d.int(math.MaxUint8)
+	function.UpvalueCount = d.int(math.MaxUint8 + 1)
+
+	ck := &function.Ck
+	ck.Codes = append([]byte(nil), d.bytes(d.int(len(d.data)))...)
+
+	runs := d.int(len(ck.Codes))
+	for i := 0; i < runs; i++ {
+		run := PositionRun{Offset: d.int(len(ck.Codes) - 1)}
+		run.Line = d.int(math.MaxInt32)
+		run.Column = d.int(math.MaxInt32)
+		if i > 0 && run.Offset <= ck.Positions[i-1].Offset {
+			d.fail("position table out of order")
+		}
+		ck.Positions = append(ck.Positions, run)
+	}
+
+	constants := d.int(len(d.data))
+	for i := 0; i < constants; i++ {
+		var constant Value
+		switch tag := d.byte(); tag {
+		case TAG_NIL:
+			constant = Nil
+		case TAG_FALSE:
+			constant = False
+		case TAG_TRUE:
+			constant = True
+		case TAG_NUMBER:
+			constant = NewNumber(math.Float64frombits(binary.LittleEndian.Uint64(d.bytes(8))))
+		case TAG_STRING:
+			constant = NewObject(&d.hp.InternString(d.string()).Object)
+		case TAG_FUNCTION:
+			constant = NewObject(&d.function().Object)
+		default:
+			d.fail("unknown constant tag %d", tag)
+		}
+		ck.Constants = append(ck.Constants, constant)
+	}
+
+	// Allocate while still listed in d.functions so a collection triggered
+	// here keeps the constants alive.
+	d.hp.Allocate(NewFunction(function))
+	d.functions = d.functions[:len(d.functions)-1]
+	return function
+}
+
+func (d *decoder) byte() byte {
+	return d.bytes(1)[0]
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n > len(d.data)-d.pos {
+		d.fail("unexpected end of file")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	x, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("malformed integer")
+	}
+	d.pos += n
+	return x
+}
+
+// int reads an integer that must not exceed max.
+func (d *decoder) int(max int) int {
+	x := d.uvarint()
+	if x > uint64(max) {
+		d.fail("value %d out of range", x)
+	}
+	return int(x)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.int(len(d.data))))
+}
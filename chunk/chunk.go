@@ -1,5 +1,7 @@
 package chunk
 
+import "sort"
+
 const (
 	OP_RETURN byte = iota
 	OP_CONSTANT
@@ -26,12 +28,136 @@ const (
 	OP_JUMP
 	OP_LOOP
 	OP_CALL
+	OP_CLOSURE
+	OP_GET_UPVALUE
+	OP_SET_UPVALUE
+	OP_CLOSE_UPVALUE
+	OP_CLASS
+	OP_GET_PROPERTY
+	OP_SET_PROPERTY
+	OP_METHOD
+	OP_INVOKE
+	OP_INHERIT
+	OP_GET_SUPER
+	OP_SUPER_INVOKE
+	OP_CONSTANT_LONG
+	OP_DEFINE_GLOBAL_LONG
+	OP_GET_GLOBAL_LONG
+	OP_SET_GLOBAL_LONG
+	OP_NOT_EQUAL
+	OP_GREATER_EQUAL
+	OP_LESS_EQUAL
+	OP_POP_JUMP_IF_FALSE
+	OP_MODULO
+	OP_FLOOR_DIVIDE
+	OP_POWER
+	OP_BIT_AND
+	OP_BIT_OR
+	OP_BIT_XOR
+	OP_BIT_NOT
+	OP_SHIFT_LEFT
+	OP_SHIFT_RIGHT
+	OP_CLOSURE_LONG
+	OP_CLASS_LONG
+	OP_GET_PROPERTY_LONG
+	OP_SET_PROPERTY_LONG
+	OP_METHOD_LONG
+	OP_INVOKE_LONG
+	OP_GET_SUPER_LONG
+	OP_SUPER_INVOKE_LONG
 )
 
+// MAX_CONSTANT_INDEX is the largest constant index a long instruction's
+// 24-bit operand can hold. Every instruction with a constant operand has a
+// long form.
+const MAX_CONSTANT_INDEX = 1<<24 - 1
+
+// opNames lists every opcode by value. Serialized bytecode records a hash of
+// it, so files written by a build with a different instruction set are
+// rejected.
+var opNames = [...]string{
+	OP_RETURN:             "OP_RETURN",
+	OP_CONSTANT:           "OP_CONSTANT",
+	OP_NEGATE:             "OP_NEGATE",
+	OP_ADD:                "OP_ADD",
+	OP_SUBTRACT:           "OP_SUBTRACT",
+	OP_MULTIPLY:           "OP_MULTIPLY",
+	OP_DIVIDE:             "OP_DIVIDE",
+	OP_NIL:                "OP_NIL",
+	OP_FALSE:              "OP_FALSE",
+	OP_TRUE:               "OP_TRUE",
+	OP_NOT:                "OP_NOT",
+	OP_EQUAL:              "OP_EQUAL",
+	OP_GREATER:            "OP_GREATER",
+	OP_LESS:               "OP_LESS",
+	OP_PRINT:              "OP_PRINT",
+	OP_POP:                "OP_POP",
+	OP_DEFINE_GLOBAL:      "OP_DEFINE_GLOBAL",
+	OP_GET_GLOBAL:         "OP_GET_GLOBAL",
+	OP_SET_GLOBAL:         "OP_SET_GLOBAL",
+	OP_GET_LOCAL:          "OP_GET_LOCAL",
+	OP_SET_LOCAL:          "OP_SET_LOCAL",
+	OP_JUMP_IF_FALSE:      "OP_JUMP_IF_FALSE",
+	OP_JUMP:               "OP_JUMP",
+	OP_LOOP:               "OP_LOOP",
+	OP_CALL:               "OP_CALL",
+	OP_CLOSURE:            "OP_CLOSURE",
+	OP_GET_UPVALUE:        "OP_GET_UPVALUE",
+	OP_SET_UPVALUE:        "OP_SET_UPVALUE",
+	OP_CLOSE_UPVALUE:      "OP_CLOSE_UPVALUE",
+	OP_CLASS:              "OP_CLASS",
+	OP_GET_PROPERTY:       "OP_GET_PROPERTY",
+	OP_SET_PROPERTY:       "OP_SET_PROPERTY",
+	OP_METHOD:             "OP_METHOD",
+	OP_INVOKE:             "OP_INVOKE",
+	OP_INHERIT:            "OP_INHERIT",
+	OP_GET_SUPER:          "OP_GET_SUPER",
+	OP_SUPER_INVOKE:       "OP_SUPER_INVOKE",
+	OP_CONSTANT_LONG:      "OP_CONSTANT_LONG",
+	OP_DEFINE_GLOBAL_LONG: "OP_DEFINE_GLOBAL_LONG",
+	OP_GET_GLOBAL_LONG:    "OP_GET_GLOBAL_LONG",
+	OP_SET_GLOBAL_LONG:    "OP_SET_GLOBAL_LONG",
+	OP_NOT_EQUAL:          "OP_NOT_EQUAL",
+	OP_GREATER_EQUAL:      "OP_GREATER_EQUAL",
+	OP_LESS_EQUAL:         "OP_LESS_EQUAL",
+	OP_POP_JUMP_IF_FALSE:  "OP_POP_JUMP_IF_FALSE",
+	OP_MODULO:             "OP_MODULO",
+	OP_FLOOR_DIVIDE:       "OP_FLOOR_DIVIDE",
+	OP_POWER:              "OP_POWER",
+	OP_BIT_AND:            "OP_BIT_AND",
+	OP_BIT_OR:             "OP_BIT_OR",
+	OP_BIT_XOR:            "OP_BIT_XOR",
+	OP_BIT_NOT:            "OP_BIT_NOT",
+	OP_SHIFT_LEFT:         "OP_SHIFT_LEFT",
+	OP_SHIFT_RIGHT:        "OP_SHIFT_RIGHT",
+	OP_CLOSURE_LONG:       "OP_CLOSURE_LONG",
+	OP_CLASS_LONG:         "OP_CLASS_LONG",
+	OP_GET_PROPERTY_LONG:  "OP_GET_PROPERTY_LONG",
+	OP_SET_PROPERTY_LONG:  "OP_SET_PROPERTY_LONG",
+	OP_METHOD_LONG:        "OP_METHOD_LONG",
+	OP_INVOKE_LONG:        "OP_INVOKE_LONG",
+	OP_GET_SUPER_LONG:     "OP_GET_SUPER_LONG",
+	OP_SUPER_INVOKE_LONG:  "OP_SUPER_INVOKE_LONG",
+}
+
 type Chunk struct {
 	Codes     []byte
 	Constants []Value
-	Lines     []int
+	// Positions maps code offsets back to the source. It is run-length
+	// encoded: each run covers the code from its Offset up to the next run's.
+	Positions []PositionRun
+}
+
+// Position is the 1-based line and column of the token an instruction was
+// compiled from.
+type Position struct {
+	Line   int
+	Column int
+}
+
+type PositionRun struct {
+	Offset int
+	Position
 }
 
 func NewChunk() *Chunk {
@@ -40,12 +166,37 @@ func NewChunk() *Chunk {
 	}
 }
 
-func (ck *Chunk) Write(code byte, line int) {
+func (ck *Chunk) Write(code byte, pos Position) {
 	ck.Codes = append(ck.Codes, code)
-	ck.Lines = append(ck.Lines, line)
+	if n := len(ck.Positions); n == 0 || ck.Positions[n-1].Position != pos {
+		ck.Positions = append(ck.Positions, PositionRun{Offset: len(ck.Codes) - 1, Position: pos})
+	}
+}
+
+// GetPosition returns the source position of the code at offset.
+func (ck *Chunk) GetPosition(offset int) Position {
+	i := sort.Search(len(ck.Positions), func(i int) bool {
+		return ck.Positions[i].Offset > offset
+	})
+	if i == 0 {
+		return Position{}
+	}
+	return ck.Positions[i-1].Position
+}
+
+func (ck *Chunk) GetLine(offset int) int {
+	return ck.GetPosition(offset).Line
 }
 
 func (ck *Chunk) AddConstant(constant Value) int {
 	ck.Constants = append(ck.Constants, constant)
 	return len(ck.Constants) - 1
 }
+
+// Truncate drops the code from offset on, along with its positions.
+func (ck *Chunk) Truncate(offset int) {
+	ck.Codes = ck.Codes[:offset]
+	for n := len(ck.Positions); n > 0 && ck.Positions[n-1].Offset >= offset; n-- {
+		ck.Positions = ck.Positions[:n-1]
+	}
+}
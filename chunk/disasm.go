@@ -14,11 +14,13 @@ func DisAsmChunk(ck *Chunk, name string) {
 
 func DisAsmInstruction(ck *Chunk, offset int) int {
 	utils.PrintfDbg("%04d ", offset)
-	if offset > 0 && ck.Lines[offset] == ck.Lines[offset-1] {
-		utils.PrintfDbg("   | ")
+	pos := ck.GetPosition(offset)
+	if offset > 0 && pos.Line == ck.GetLine(offset-1) {
+		utils.PrintfDbg("   |")
 	} else {
-		utils.PrintfDbg("%4d ", ck.Lines[offset])
+		utils.PrintfDbg("%4d", pos.Line)
 	}
+	utils.PrintfDbg(":%-3d ", pos.Column)
 
 	instruction := ck.Codes[offset]
 	switch instruction {
@@ -72,6 +74,80 @@ func DisAsmInstruction(ck *Chunk, offset int) int {
 		return jumpInstruction("OP_LOOP", -1, ck, offset)
 	case OP_CALL:
 		return byteInstruction("OP_CALL", ck, offset)
+	case OP_CLOSURE:
+		return closureInstruction("OP_CLOSURE", ck, offset)
+	case OP_CLOSURE_LONG:
+		return closureInstruction("OP_CLOSURE_LONG", ck, offset)
+	case OP_GET_UPVALUE:
+		return byteInstruction("OP_GET_UPVALUE", ck, offset)
+	case OP_SET_UPVALUE:
+		return byteInstruction("OP_SET_UPVALUE", ck, offset)
+	case OP_CLOSE_UPVALUE:
+		return simpleInstruction("OP_CLOSE_UPVALUE", offset)
+	case OP_CLASS:
+		return constantInstruction("OP_CLASS", ck, offset)
+	case OP_GET_PROPERTY:
+		return constantInstruction("OP_GET_PROPERTY", ck, offset)
+	case OP_SET_PROPERTY:
+		return constantInstruction("OP_SET_PROPERTY", ck, offset)
+	case OP_METHOD:
+		return constantInstruction("OP_METHOD", ck, offset)
+	case OP_INVOKE:
+		return invokeInstruction("OP_INVOKE", ck, offset)
+	case OP_INVOKE_LONG:
+		return invokeInstruction("OP_INVOKE_LONG", ck, offset)
+	case OP_INHERIT:
+		return simpleInstruction("OP_INHERIT", offset)
+	case OP_GET_SUPER:
+		return constantInstruction("OP_GET_SUPER", ck, offset)
+	case OP_SUPER_INVOKE:
+		return invokeInstruction("OP_SUPER_INVOKE", ck, offset)
+	case OP_SUPER_INVOKE_LONG:
+		return invokeInstruction("OP_SUPER_INVOKE_LONG", ck, offset)
+	case OP_CONSTANT_LONG:
+		return constantLongInstruction("OP_CONSTANT_LONG", ck, offset)
+	case OP_DEFINE_GLOBAL_LONG:
+		return constantLongInstruction("OP_DEFINE_GLOBAL_LONG", ck, offset)
+	case OP_GET_GLOBAL_LONG:
+		return constantLongInstruction("OP_GET_GLOBAL_LONG", ck, offset)
+	case OP_SET_GLOBAL_LONG:
+		return constantLongInstruction("OP_SET_GLOBAL_LONG", ck, offset)
+	case OP_CLASS_LONG:
+		return constantLongInstruction("OP_CLASS_LONG", ck, offset)
+	case OP_GET_PROPERTY_LONG:
+		return constantLongInstruction("OP_GET_PROPERTY_LONG", ck, offset)
+	case OP_SET_PROPERTY_LONG:
+		return constantLongInstruction("OP_SET_PROPERTY_LONG", ck, offset)
+	case OP_METHOD_LONG:
+		return constantLongInstruction("OP_METHOD_LONG", ck, offset)
+	case OP_GET_SUPER_LONG:
+		return constantLongInstruction("OP_GET_SUPER_LONG", ck, offset)
+	case OP_NOT_EQUAL:
+		return simpleInstruction("OP_NOT_EQUAL", offset)
+	case OP_GREATER_EQUAL:
+		return simpleInstruction("OP_GREATER_EQUAL", offset)
+	case OP_LESS_EQUAL:
+		return simpleInstruction("OP_LESS_EQUAL", offset)
+	case OP_POP_JUMP_IF_FALSE:
+		return jumpInstruction("OP_POP_JUMP_IF_FALSE", 1, ck, offset)
+	case OP_MODULO:
+		return simpleInstruction("OP_MODULO", offset)
+	case OP_FLOOR_DIVIDE:
+		return simpleInstruction("OP_FLOOR_DIVIDE", offset)
+	case OP_POWER:
+		return simpleInstruction("OP_POWER", offset)
+	case OP_BIT_AND:
+		return simpleInstruction("OP_BIT_AND", offset)
+	case OP_BIT_OR:
+		return simpleInstruction("OP_BIT_OR", offset)
+	case OP_BIT_XOR:
+		return simpleInstruction("OP_BIT_XOR", offset)
+	case OP_BIT_NOT:
+		return simpleInstruction("OP_BIT_NOT", offset)
+	case OP_SHIFT_LEFT:
+		return simpleInstruction("OP_SHIFT_LEFT", offset)
+	case OP_SHIFT_RIGHT:
+		return simpleInstruction("OP_SHIFT_RIGHT", offset)
 	default:
 		utils.PrintfDbg("Unknown opcode %d\n", instruction)
 		return offset + 1
@@ -91,6 +167,24 @@ func constantInstruction(name string, ck *Chunk, offset int) int {
 	return offset + 2
 }
 
+func constantLongInstruction(name string, ck *Chunk, offset int) int {
+	idx := constantOperand(ck.Codes, offset)
+	utils.PrintfDbg("%-16s   const[%d] '", name, idx)
+	utils.PrintfDbg(ck.Constants[idx].String())
+	utils.PrintfDbg("\n")
+	return offset + 4
+}
+
+func invokeInstruction(name string, ck *Chunk, offset int) int {
+	idx := constantOperand(ck.Codes, offset)
+	size := 1 + operandSize(ck.Codes[offset])
+	argCount := ck.Codes[offset+size-1]
+	utils.PrintfDbg("%-16s   (%d args) const[%d] '", name, argCount, idx)
+	utils.PrintfDbg(ck.Constants[idx].String())
+	utils.PrintfDbg("\n")
+	return offset + size
+}
+
 func byteInstruction(name string, ck *Chunk, offset int) int {
 	slot := ck.Codes[offset+1]
 	utils.PrintfDbg("%-16s    slot[%d]\n", name, slot)
@@ -103,3 +197,22 @@ func jumpInstruction(name string, sign int, ck *Chunk, offset int) int {
 	utils.PrintfDbg("%-16s %4d -> %d\n", name, offset, offset+3+sign*int(jump))
 	return offset + 3
 }
+
+func closureInstruction(name string, ck *Chunk, offset int) int {
+	idx := constantOperand(ck.Codes, offset)
+	utils.PrintfDbg("%-16s   const[%d] '", name, idx)
+	utils.PrintfDbg(ck.Constants[idx].String())
+	utils.PrintfDbg("\n")
+
+	offset += 1 + operandSize(ck.Codes[offset])
+	function := ck.Constants[idx].AsObject().AsFunction()
+	for i := 0; i < function.UpvalueCount; i++ {
+		kind := "upvalue"
+		if ck.Codes[offset] == 1 {
+			kind = "local"
+		}
+		utils.PrintfDbg("%04d    |                       %s %d\n", offset, kind, ck.Codes[offset+1])
+		offset += 2
+	}
+	return offset
+}
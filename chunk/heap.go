@@ -0,0 +1,285 @@
+package chunk
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+const (
+	DEFAULT_GROW_FACTOR = 2
+	DEFAULT_INITIAL_GC  = 1024 * 1024
+)
+
+// Heap owns every object allocated by the compiler and the vm. Objects are
+// linked through Object.next, and a tri-colour mark-and-sweep collector
+// frees those no longer reachable from the registered roots.
+type Heap struct {
+	objects        *Object
+	strings        Table
+	grayStack      []*Object
+	roots          []func(hp *Heap)
+	bytesAllocated int
+	nextGC         int
+	stats          HeapStats
+
+	// GrowFactor scales the live heap size after a collection to pick the
+	// threshold for the next one.
+	GrowFactor int
+	// StressGC collects before every allocation to flush out missing roots.
+	StressGC bool
+	// MaxBytes is the most the heap may hold after a collection; 0 means
+	// unlimited.
+	MaxBytes int
+}
+
+// OutOfMemory is panicked by Allocate when an allocation would push the heap
+// past MaxBytes even after a full collection.
+type OutOfMemory struct {
+	Requested int
+	Limit     int
+}
+
+func (e OutOfMemory) Error() string {
+	return fmt.Sprintf("out of memory: allocating %d bytes exceeds the %d byte heap limit", e.Requested, e.Limit)
+}
+
+type HeapStats struct {
+	Objects        int
+	BytesAllocated int
+	NextGC         int
+	Collections    int
+	ObjectsFreed   int
+	BytesFreed     int
+}
+
+func NewHeap() *Heap {
+	hp := &Heap{
+		nextGC:     DEFAULT_INITIAL_GC,
+		GrowFactor: DEFAULT_GROW_FACTOR,
+	}
+	hp.strings.heap = hp
+	return hp
+}
+
+// PushRoots registers a function that marks a set of roots on every
+// collection. Roots are kept in a stack so that short-lived owners, like an
+// in-flight compilation, can remove theirs with PopRoots.
+func (hp *Heap) PushRoots(markRoots func(hp *Heap)) {
+	hp.roots = append(hp.roots, markRoots)
+}
+
+func (hp *Heap) PopRoots() {
+	hp.roots = hp.roots[:len(hp.roots)-1]
+}
+
+// Allocate links a freshly created object into the heap, running a
+// collection first if the heap has grown past its threshold. The new object
+// itself is never collected by that run, but anything it refers to must
+// already be reachable from a root.
+func (hp *Heap) Allocate(obj *Object) *Object {
+	hp.reserve(obj.size)
+	switch obj.ot {
+	case OBJ_CLASS:
+		obj.AsClass().Methods.heap = hp
+	case OBJ_INSTANCE:
+		obj.AsInstance().Fields.heap = hp
+	}
+
+	hp.bytesAllocated += obj.size
+	hp.stats.Objects++
+	obj.next = hp.objects
+	hp.objects = obj
+	return obj
+}
+
+// TrackTable makes the heap account for the entries of a table that does
+// not belong to an object, such as the vm's globals, so that they count
+// towards MaxBytes.
+func (hp *Heap) TrackTable(tb *Table) {
+	tb.heap = hp
+	hp.bytesAllocated += tableBytes(len(tb.entries))
+}
+
+// reserve makes room for size more bytes, collecting first if the heap has
+// grown past its threshold and panicking with OutOfMemory if it would still
+// exceed MaxBytes.
+func (hp *Heap) reserve(size int) {
+	if hp.StressGC || hp.bytesAllocated+size > hp.nextGC {
+		hp.Collect()
+	} else if hp.MaxBytes > 0 && hp.bytesAllocated+size > hp.MaxBytes {
+		hp.Collect()
+	}
+	if hp.MaxBytes > 0 && hp.bytesAllocated+size > hp.MaxBytes {
+		panic(OutOfMemory{Requested: size, Limit: hp.MaxBytes})
+	}
+}
+
+// growTable accounts for a table growing from oldCapacity to capacity
+// entries. Like Allocate it may collect, so everything in the table must
+// already be reachable.
+func (hp *Heap) growTable(oldCapacity, capacity int) {
+	size := tableBytes(capacity) - tableBytes(oldCapacity)
+	hp.reserve(size)
+	hp.bytesAllocated += size
+}
+
+func tableBytes(capacity int) int {
+	return capacity * int(unsafe.Sizeof(entry{}))
+}
+
+// tableBytes is what the entries of an object's table add to its size.
+func (obj *Object) tableBytes() int {
+	switch obj.ot {
+	case OBJ_CLASS:
+		return tableBytes(len(obj.AsClass().Methods.entries))
+	case OBJ_INSTANCE:
+		return tableBytes(len(obj.AsInstance().Fields.entries))
+	}
+	return 0
+}
+
+// InternString returns the unique string object holding chars, allocating
+// it on first use.
+func (hp *Heap) InternString(chars string) *ObjString {
+	hash := hashString(chars)
+	if interned := hp.strings.FindString(chars, hash); interned != nil {
+		return interned
+	}
+
+	// Grow the table first: growing may collect, which would sweep the new
+	// string before it is in the table.
+	hp.strings.reserve()
+	str := hp.Allocate(NewString(chars, hash)).AsString()
+	hp.strings.Set(str, Nil)
+	return str
+}
+
+func (hp *Heap) Collect() {
+	for _, markRoots := range hp.roots {
+		markRoots(hp)
+	}
+	hp.traceReferences()
+	hp.strings.removeWhite()
+	hp.sweep()
+
+	growFactor := hp.GrowFactor
+	if growFactor < 1 {
+		growFactor = DEFAULT_GROW_FACTOR
+	}
+	hp.nextGC = hp.bytesAllocated * growFactor
+	if hp.nextGC < DEFAULT_INITIAL_GC {
+		hp.nextGC = DEFAULT_INITIAL_GC
+	}
+	hp.stats.Collections++
+}
+
+func (hp *Heap) Stats() HeapStats {
+	stats := hp.stats
+	stats.BytesAllocated = hp.bytesAllocated
+	stats.NextGC = hp.nextGC
+	return stats
+}
+
+func (hp *Heap) MarkValue(val Value) {
+	if val.IsObject() {
+		hp.MarkObject(val.AsObject())
+	}
+}
+
+func (hp *Heap) MarkObject(obj *Object) {
+	if obj == nil || obj.isMarked {
+		return
+	}
+	obj.isMarked = true
+	hp.grayStack = append(hp.grayStack, obj)
+}
+
+func (hp *Heap) traceReferences() {
+	for len(hp.grayStack) > 0 {
+		obj := hp.grayStack[len(hp.grayStack)-1]
+		hp.grayStack = hp.grayStack[:len(hp.grayStack)-1]
+		hp.blackenObject(obj)
+	}
+}
+
+func (hp *Heap) blackenObject(obj *Object) {
+	switch obj.ot {
+	case OBJ_FUNCTION:
+		hp.MarkConstants(obj.AsFunction())
+	case OBJ_CLOSURE:
+		closure := obj.AsClosure()
+		hp.MarkObject(&closure.Function.Object)
+		for _, upvalue := range closure.Upvalues {
+			if upvalue != nil {
+				hp.MarkObject(&upvalue.Object)
+			}
+		}
+	case OBJ_UPVALUE:
+		hp.MarkValue(obj.AsUpvalue().Closed)
+	case OBJ_CLASS:
+		obj.AsClass().Methods.mark(hp)
+	case OBJ_INSTANCE:
+		instance := obj.AsInstance()
+		hp.MarkObject(&instance.Class.Object)
+		instance.Fields.mark(hp)
+	case OBJ_BOUND_METHOD:
+		bound := obj.AsBoundMethod()
+		hp.MarkValue(bound.Receiver)
+		hp.MarkObject(&bound.Method.Object)
+	case OBJ_NATIVE, OBJ_STRING:
+		// No references.
+	}
+}
+
+// MarkTable marks every key and value held in tb.
+func (hp *Heap) MarkTable(tb *Table) {
+	tb.mark(hp)
+}
+
+// MarkConstants marks everything referenced from a function's constant
+// table. The compiler uses it for functions that are still being compiled
+// and so have not been allocated yet.
+func (hp *Heap) MarkConstants(function *ObjFunction) {
+	for _, constant := range function.Ck.Constants {
+		hp.MarkValue(constant)
+	}
+}
+
+func (hp *Heap) sweep() {
+	var previous *Object
+	obj := hp.objects
+	for obj != nil {
+		if obj.isMarked {
+			obj.isMarked = false
+			previous = obj
+			obj = obj.next
+			continue
+		}
+
+		unreached := obj
+		obj = obj.next
+		if previous != nil {
+			previous.next = obj
+		} else {
+			hp.objects = obj
+		}
+
+		// Unlinked objects are left for the Go runtime to reclaim.
+		unreached.next = nil
+		freed := unreached.size + unreached.tableBytes()
+		hp.bytesAllocated -= freed
+		hp.stats.Objects--
+		hp.stats.ObjectsFreed++
+		hp.stats.BytesFreed += freed
+	}
+}
+
+// hashString is 32-bit FNV-1a.
+func hashString(chars string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(chars); i++ {
+		hash ^= uint32(chars[i])
+		hash *= 16777619
+	}
+	return hash
+}
@@ -0,0 +1,95 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHeapCollect(t *testing.T) {
+	hp := NewHeap()
+
+	kept := hp.Allocate(NewClass("Kept"))
+	method := hp.Allocate(NewClosure(hp.Allocate(NewFunction(&ObjFunction{Name: "m"})).AsFunction()))
+	kept.AsClass().Methods.Set(hp.InternString("m"), NewObject(method))
+	hp.Allocate(NewClass("Garbage"))
+
+	hp.PushRoots(func(hp *Heap) {
+		hp.MarkObject(kept)
+	})
+
+	for i := 0; i < 2; i++ {
+		hp.Collect()
+		stats := hp.Stats()
+		if stats.Objects != 4 {
+			t.Fatalf("collection %d: expected 4 live objects, got %d", i+1, stats.Objects)
+		}
+		if stats.ObjectsFreed != 1 {
+			t.Fatalf("collection %d: expected 1 freed object, got %d", i+1, stats.ObjectsFreed)
+		}
+	}
+
+	hp.PopRoots()
+	hp.Collect()
+	// Only the intern table's entries remain.
+	if stats := hp.Stats(); stats.Objects != 0 || stats.BytesAllocated != tableBytes(len(hp.strings.entries)) {
+		t.Fatalf("expected an empty heap, got %+v", stats)
+	}
+}
+
+func TestInternString(t *testing.T) {
+	hp := NewHeap()
+	hp.StressGC = true
+
+	kept := hp.InternString("kept")
+	hp.PushRoots(func(hp *Heap) {
+		hp.MarkObject(&kept.Object)
+	})
+	hp.InternString("garbage")
+	hp.Collect()
+
+	if hp.InternString("kept") != kept {
+		t.Error("a reachable string was interned twice")
+	}
+	if hp.strings.FindString("garbage", hashString("garbage")) != nil {
+		t.Error("the intern table kept an unreachable string")
+	}
+	if stats := hp.Stats(); stats.Objects != 1 {
+		t.Errorf("expected 1 live object, got %d", stats.Objects)
+	}
+	hp.PopRoots()
+}
+
+func TestTableBytes(t *testing.T) {
+	hp := NewHeap()
+	instance := hp.Allocate(NewInstance(hp.Allocate(NewClass("C")).AsClass())).AsInstance()
+	keys := make([]*ObjString, 100)
+	for i := range keys {
+		keys[i] = hp.InternString(fmt.Sprint("f", i))
+	}
+	hp.PushRoots(func(hp *Heap) {
+		hp.MarkObject(&instance.Object)
+		for _, key := range keys {
+			hp.MarkObject(&key.Object)
+		}
+	})
+
+	// Only the fields table grows from here, so it alone must hit the limit.
+	hp.MaxBytes = hp.Stats().BytesAllocated + tableBytes(64)
+	func() {
+		defer func() {
+			if _, ok := recover().(OutOfMemory); !ok {
+				t.Error("growing the fields table did not run out of memory")
+			}
+		}()
+		for _, key := range keys {
+			instance.Fields.Set(key, Nil)
+		}
+	}()
+
+	hp.MaxBytes = 0
+	hp.PopRoots()
+	hp.Collect()
+	if stats := hp.Stats(); stats.Objects != 0 || stats.BytesAllocated != tableBytes(len(hp.strings.entries)) {
+		t.Fatalf("fields were not released with their instance: %+v", stats)
+	}
+}
@@ -1,78 +1,256 @@
 package chunk
 
+import "unsafe"
+
 type ObjType uint8
 type FunType uint8
 
 const (
 	OBJ_FUNCTION ObjType = iota
 	OBJ_NATIVE
+	OBJ_CLOSURE
+	OBJ_UPVALUE
+	OBJ_CLASS
+	OBJ_INSTANCE
+	OBJ_BOUND_METHOD
+	OBJ_STRING
 )
 
 const (
 	FUNCTION FunType = iota
 	SCRIPT
+	METHOD
+	INITIALIZER
 )
 
+// Object is the header shared by every heap-allocated value. Each concrete
+// object type embeds it, and content points back at the concrete value.
+// Objects are chained through next so the heap can sweep them.
 type Object struct {
-	ot      ObjType
-	next    *Object
-	content interface{}
+	ot       ObjType
+	isMarked bool
+	size     int
+	next     *Object
+	content  interface{}
 }
 
-func (val Value) AsObject() Object {
-	return val.v.(Object)
+func (val Value) AsObject() *Object {
+	return val.obj
 }
 
 func (val Value) IsObject() bool {
 	return val.lt == VAL_OBJECT
 }
 
-func NewObject(obj Object) Value {
+func NewObject(obj *Object) Value {
 	return Value{
-		lt: VAL_OBJECT,
-		v:  obj,
+		lt:  VAL_OBJECT,
+		obj: obj,
+	}
+}
+
+func (obj *Object) init(ot ObjType, content interface{}, size uintptr) *Object {
+	obj.ot = ot
+	obj.content = content
+	obj.size = int(size)
+	return obj
+}
+
+// NewString creates a string object. Strings must go through
+// Heap.InternString so that equal strings share a single object.
+func NewString(chars string, hash uint32) *Object {
+	str := &ObjString{
+		Chars: chars,
+		Hash:  hash,
+	}
+	return str.init(OBJ_STRING, str, unsafe.Sizeof(*str)+uintptr(len(chars)))
+}
+
+func NewFunction(function *ObjFunction) *Object {
+	size := unsafe.Sizeof(*function) +
+		uintptr(len(function.Ck.Codes)) +
+		uintptr(len(function.Ck.Positions))*unsafe.Sizeof(PositionRun{}) +
+		uintptr(len(function.Ck.Constants))*unsafe.Sizeof(Value{})
+	return function.init(OBJ_FUNCTION, function, size)
+}
+
+func NewNative(name string, arity int, native NativeFunction) *Object {
+	obj := &ObjNative{
+		Name:     name,
+		Arity:    arity,
+		Function: native,
+	}
+	return obj.init(OBJ_NATIVE, obj, unsafe.Sizeof(*obj)+uintptr(len(name)))
+}
+
+func NewClosure(function *ObjFunction) *Object {
+	closure := &ObjClosure{
+		Function: function,
+		Upvalues: make([]*ObjUpvalue, function.UpvalueCount),
+	}
+	size := unsafe.Sizeof(*closure) + uintptr(function.UpvalueCount)*unsafe.Sizeof(closure)
+	return closure.init(OBJ_CLOSURE, closure, size)
+}
+
+func NewUpvalue(location int) *Object {
+	upvalue := &ObjUpvalue{
+		Location: location,
+		Closed:   Nil,
+	}
+	return upvalue.init(OBJ_UPVALUE, upvalue, unsafe.Sizeof(*upvalue))
+}
+
+func NewClass(name string) *Object {
+	class := &ObjClass{
+		Name: name,
 	}
+	return class.init(OBJ_CLASS, class, unsafe.Sizeof(*class)+uintptr(len(name)))
 }
 
-func NewFunction(function ObjFunction) Object {
-	return Object{
-		ot:      OBJ_FUNCTION,
-		content: function,
+func NewInstance(class *ObjClass) *Object {
+	instance := &ObjInstance{
+		Class: class,
 	}
+	return instance.init(OBJ_INSTANCE, instance, unsafe.Sizeof(*instance))
 }
 
-func NewNative(native NativeFunction) Object {
-	return Object{
-		ot:      OBJ_NATIVE,
-		content: native,
+func NewBoundMethod(receiver Value, method *ObjClosure) *Object {
+	bound := &ObjBoundMethod{
+		Receiver: receiver,
+		Method:   method,
 	}
+	return bound.init(OBJ_BOUND_METHOD, bound, unsafe.Sizeof(*bound))
+}
+
+type ObjString struct {
+	Object
+	Chars string
+	Hash  uint32
 }
 
 type ObjFunction struct {
-	Name  string
-	Arity int
-	Ck    Chunk
+	Object
+	Name         string
+	Arity        int
+	UpvalueCount int
+	Ck           Chunk
 }
 
-type NativeFunction func(args ...Value) Value
+type ObjNative struct {
+	Object
+	Name string
+	// Arity is the exact number of arguments expected, or VARIADIC.
+	Arity    int
+	Function NativeFunction
+}
+
+type ObjClosure struct {
+	Object
+	Function *ObjFunction
+	Upvalues []*ObjUpvalue
+}
+
+// ObjUpvalue refers to a local variable captured by a closure. While the
+// variable is still on the stack, Location is its stack index; once closed,
+// Location is -1 and the value lives in Closed.
+type ObjUpvalue struct {
+	Object
+	Location int
+	Closed   Value
+	Next     *ObjUpvalue
+}
+
+type ObjClass struct {
+	Object
+	Name    string
+	Methods Table
+}
+
+type ObjInstance struct {
+	Object
+	Class  *ObjClass
+	Fields Table
+}
+
+type ObjBoundMethod struct {
+	Object
+	Receiver Value
+	Method   *ObjClosure
+}
+
+// VARIADIC is the arity of natives that accept any number of arguments.
+const VARIADIC = -1
+
+// NativeFunction implements a function in Go. args aliases the vm stack and
+// must not be retained after the call. A non-nil error becomes a runtime
+// error in the calling script.
+type NativeFunction func(args ...Value) (Value, error)
+
+func (obj *Object) IsString() bool {
+	return obj.ot == OBJ_STRING
+}
+
+func (obj *Object) AsString() *ObjString {
+	return obj.content.(*ObjString)
+}
 
 func (obj *Object) IsFunction() bool {
 	return obj.ot == OBJ_FUNCTION
 }
 
-func (obj Object) AsFunction() ObjFunction {
-	return obj.content.(ObjFunction)
+func (obj *Object) AsFunction() *ObjFunction {
+	return obj.content.(*ObjFunction)
+}
+
+func (obj *Object) IsClosure() bool {
+	return obj.ot == OBJ_CLOSURE
+}
+
+func (obj *Object) AsClosure() *ObjClosure {
+	return obj.content.(*ObjClosure)
+}
+
+func (obj *Object) AsUpvalue() *ObjUpvalue {
+	return obj.content.(*ObjUpvalue)
 }
 
-func (obj Object) IsNative() bool {
+func (uv *ObjUpvalue) IsOpen() bool {
+	return uv.Location != -1
+}
+
+func (obj *Object) IsNative() bool {
 	return obj.ot == OBJ_NATIVE
 }
 
-func (obj Object) AsNative() NativeFunction {
-	return obj.content.(NativeFunction)
+func (obj *Object) AsNative() *ObjNative {
+	return obj.content.(*ObjNative)
+}
+
+func (obj *Object) IsClass() bool {
+	return obj.ot == OBJ_CLASS
+}
+
+func (obj *Object) AsClass() *ObjClass {
+	return obj.content.(*ObjClass)
+}
+
+func (obj *Object) IsInstance() bool {
+	return obj.ot == OBJ_INSTANCE
+}
+
+func (obj *Object) AsInstance() *ObjInstance {
+	return obj.content.(*ObjInstance)
+}
+
+func (obj *Object) IsBoundMethod() bool {
+	return obj.ot == OBJ_BOUND_METHOD
+}
+
+func (obj *Object) AsBoundMethod() *ObjBoundMethod {
+	return obj.content.(*ObjBoundMethod)
 }
 
-func (of ObjFunction) GetName() string {
+func (of *ObjFunction) GetName() string {
 	name := of.Name
 	if name == "" {
 		return "script"
@@ -80,13 +258,25 @@ func (of ObjFunction) GetName() string {
 	return name
 }
 
-func (obj Object) String() string {
+func (obj *Object) String() string {
 	var str string
 	switch obj.ot {
+	case OBJ_STRING:
+		str = obj.AsString().Chars
 	case OBJ_FUNCTION:
 		str = "<fn " + obj.AsFunction().GetName() + ">"
 	case OBJ_NATIVE:
 		str = "<native fn>"
+	case OBJ_CLOSURE:
+		str = "<fn " + obj.AsClosure().Function.GetName() + ">"
+	case OBJ_UPVALUE:
+		str = "upvalue"
+	case OBJ_CLASS:
+		str = obj.AsClass().Name
+	case OBJ_INSTANCE:
+		str = obj.AsInstance().Class.Name + " instance"
+	case OBJ_BOUND_METHOD:
+		str = "<fn " + obj.AsBoundMethod().Method.Function.GetName() + ">"
 	}
 	return str
 }
@@ -0,0 +1,290 @@
+package chunk
+
+import "math"
+
+// Optimize rewrites the code of ck in place with peephole optimizations:
+//
+//   - OP_EQUAL OP_NOT, OP_LESS OP_NOT and OP_GREATER OP_NOT become
+//     OP_NOT_EQUAL, OP_GREATER_EQUAL and OP_LESS_EQUAL;
+//   - jumps to unconditional jumps go straight to the final target, and
+//     jumps to the next instruction are dropped;
+//   - OP_JUMP_IF_FALSE followed by OP_POP on both paths becomes a single
+//     OP_POP_JUMP_IF_FALSE;
+//   - unreachable code, such as anything after OP_RETURN, is removed.
+//
+// Jump offsets and the position table are rebuilt to match. ck must hold
+// code produced by the compiler, in which every jump lands on an
+// instruction.
+func Optimize(ck *Chunk) {
+	if len(ck.Codes) == 0 {
+		return
+	}
+	o := newOptimizer(ck)
+	o.markUnreachable()
+	o.fuseComparisons()
+	o.collapseJumpChains()
+	o.fusePopJumps()
+	o.markUnreachable()
+	o.dropJumpsToNext()
+	o.encode()
+}
+
+type instruction struct {
+	op       byte
+	operands []byte
+	// target is the index of the instruction a jump lands on; len(insts)
+	// stands for the end of the code.
+	target int
+	offset int
+	pos    Position
+	dead   bool
+}
+
+type optimizer struct {
+	ck    *Chunk
+	insts []instruction
+}
+
+func newOptimizer(ck *Chunk) *optimizer {
+	o := &optimizer{ck: ck}
+	index := make(map[int]int)
+	for offset := 0; offset < len(ck.Codes); {
+		size := instructionSize(ck, offset)
+		index[offset] = len(o.insts)
+		o.insts = append(o.insts, instruction{
+			op:       ck.Codes[offset],
+			operands: ck.Codes[offset+1 : offset+size],
+			offset:   offset,
+			pos:      ck.GetPosition(offset),
+		})
+		offset += size
+	}
+	index[len(ck.Codes)] = len(o.insts)
+
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if isJump(inst.op) {
+			inst.target = index[jumpTarget(ck.Codes, inst.offset)]
+		}
+	}
+	return o
+}
+
+// next returns the index of the first live instruction after i.
+func (o *optimizer) next(i int) int {
+	for i++; i < len(o.insts) && o.insts[i].dead; i++ {
+	}
+	return i
+}
+
+// live returns i if it is live, or else the first live instruction after it.
+func (o *optimizer) live(i int) int {
+	if i < len(o.insts) && o.insts[i].dead {
+		return o.next(i)
+	}
+	return i
+}
+
+// incoming counts the live jumps landing on each instruction.
+func (o *optimizer) incoming() []int {
+	counts := make([]int, len(o.insts)+1)
+	for i := range o.insts {
+		if inst := &o.insts[i]; !inst.dead && isJump(inst.op) {
+			counts[o.live(inst.target)]++
+		}
+	}
+	return counts
+}
+
+func (o *optimizer) markUnreachable() {
+	reached := make([]bool, len(o.insts))
+	work := []int{o.live(0)}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i >= len(o.insts) || reached[i] {
+			continue
+		}
+		reached[i] = true
+
+		inst := &o.insts[i]
+		if isJump(inst.op) {
+			work = append(work, o.live(inst.target))
+		}
+		if !isUnconditional(inst.op) {
+			work = append(work, o.next(i))
+		}
+	}
+
+	for i := range o.insts {
+		if !reached[i] {
+			o.insts[i].dead = true
+		}
+	}
+}
+
+func (o *optimizer) fuseComparisons() {
+	targets := o.incoming()
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if inst.dead {
+			continue
+		}
+		not := o.next(i)
+		if not >= len(o.insts) || o.insts[not].op != OP_NOT || targets[not] > 0 {
+			continue
+		}
+
+		// These keep the meaning of the pair they replace; in particular
+		// OP_GREATER_EQUAL is !(a < b), which differs from a >= b for NaN.
+		switch inst.op {
+		case OP_EQUAL:
+			inst.op = OP_NOT_EQUAL
+		case OP_LESS:
+			inst.op = OP_GREATER_EQUAL
+		case OP_GREATER:
+			inst.op = OP_LESS_EQUAL
+		default:
+			continue
+		}
+		o.insts[not].dead = true
+	}
+}
+
+func (o *optimizer) collapseJumpChains() {
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if inst.dead || !isJump(inst.op) {
+			continue
+		}
+
+		// Conditional jumps can only go forward, so they may only follow
+		// forward jumps.
+		for hops := 0; hops < len(o.insts); hops++ {
+			t := o.live(inst.target)
+			if t >= len(o.insts) || t == i {
+				break
+			}
+			hop := &o.insts[t]
+			if hop.op != OP_JUMP && !(hop.op == OP_LOOP && isUnconditional(inst.op)) {
+				break
+			}
+			// The rewritten jump must still fit in its 16-bit operand.
+			if abs(o.offsetOf(hop.target)-inst.offset) > math.MaxUint16 {
+				break
+			}
+			inst.target = hop.target
+		}
+	}
+}
+
+// fusePopJumps turns
+//
+//	OP_JUMP_IF_FALSE L; OP_POP; ... L: OP_POP; M:
+//
+// into OP_POP_JUMP_IF_FALSE M, provided nothing else reaches the OP_POP at
+// L, as is the case for the conditions of if statements and loops.
+func (o *optimizer) fusePopJumps() {
+	targets := o.incoming()
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if inst.dead || inst.op != OP_JUMP_IF_FALSE {
+			continue
+		}
+		pop := o.next(i)
+		t := o.live(inst.target)
+		if pop >= len(o.insts) || o.insts[pop].op != OP_POP || targets[pop] > 0 {
+			continue
+		}
+		if t >= len(o.insts) || t <= pop || o.insts[t].op != OP_POP || targets[t] != 1 || o.fallsInto(t) {
+			continue
+		}
+
+		inst.op = OP_POP_JUMP_IF_FALSE
+		inst.target = o.next(t)
+		o.insts[pop].dead = true
+		o.insts[t].dead = true
+		targets = o.incoming()
+	}
+}
+
+// fallsInto reports whether the live instruction before i can continue into
+// it.
+func (o *optimizer) fallsInto(i int) bool {
+	for p := i - 1; p >= 0; p-- {
+		if !o.insts[p].dead {
+			return !isUnconditional(o.insts[p].op)
+		}
+	}
+	return true
+}
+
+func (o *optimizer) dropJumpsToNext() {
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if !inst.dead && inst.op == OP_JUMP && o.live(inst.target) == o.next(i) {
+			inst.dead = true
+		}
+	}
+}
+
+// offsetOf returns the original offset of instruction i.
+func (o *optimizer) offsetOf(i int) int {
+	if i >= len(o.insts) {
+		return len(o.ck.Codes)
+	}
+	return o.insts[i].offset
+}
+
+func (o *optimizer) encode() {
+	offsets := make([]int, len(o.insts)+1)
+	size := 0
+	for i := range o.insts {
+		offsets[i] = size
+		if !o.insts[i].dead {
+			size += 1 + len(o.insts[i].operands)
+		}
+	}
+	offsets[len(o.insts)] = size
+
+	ck := &Chunk{Constants: o.ck.Constants}
+	for i := range o.insts {
+		inst := &o.insts[i]
+		if inst.dead {
+			continue
+		}
+
+		op, operands := inst.op, inst.operands
+		if isJump(op) {
+			// Dead targets fall through to the next live instruction, whose
+			// new offset they share.
+			jump := offsets[inst.target] - (offsets[i] + 3)
+			if op == OP_JUMP && jump < 0 {
+				op = OP_LOOP
+			} else if op == OP_LOOP && jump >= 0 {
+				op = OP_JUMP
+			}
+			jump = abs(jump)
+			operands = []byte{byte(jump >> 8), byte(jump)}
+		}
+
+		ck.Write(op, inst.pos)
+		for _, operand := range operands {
+			ck.Write(operand, inst.pos)
+		}
+	}
+
+	o.ck.Codes = ck.Codes
+	o.ck.Positions = ck.Positions
+}
+
+func isUnconditional(op byte) bool {
+	return op == OP_JUMP || op == OP_LOOP || op == OP_RETURN
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
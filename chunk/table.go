@@ -0,0 +1,190 @@
+package chunk
+
+const TABLE_MAX_LOAD = 0.75
+
+// Table is an open-addressing hash table keyed by interned strings. Since
+// keys are interned, lookups compare pointers and reuse the hash cached in
+// each ObjString instead of rehashing the characters.
+type Table struct {
+	count   int
+	entries []entry
+	// heap, if set, is charged for the entries as the table grows.
+	heap *Heap
+}
+
+type entry struct {
+	key   *ObjString
+	value Value
+}
+
+func (tb *Table) Get(key *ObjString) (Value, bool) {
+	if tb.count == 0 {
+		return Nil, false
+	}
+
+	e := findEntry(tb.entries, key)
+	if e.key == nil {
+		return Nil, false
+	}
+	return e.value, true
+}
+
+// Set stores value under key and reports whether key was newly added.
+func (tb *Table) Set(key *ObjString, value Value) bool {
+	tb.reserve()
+
+	e := findEntry(tb.entries, key)
+	isNewKey := e.key == nil
+	if isNewKey && e.value.IsNil() {
+		tb.count++
+	}
+
+	e.key = key
+	e.value = value
+	return isNewKey
+}
+
+func (tb *Table) Delete(key *ObjString) bool {
+	if tb.count == 0 {
+		return false
+	}
+
+	e := findEntry(tb.entries, key)
+	if e.key == nil {
+		return false
+	}
+
+	// Leave a tombstone so probe sequences running through it still work.
+	e.key = nil
+	e.value = True
+	return true
+}
+
+func (tb *Table) AddAll(to *Table) {
+	for i := range tb.entries {
+		e := &tb.entries[i]
+		if e.key != nil {
+			to.Set(e.key, e.value)
+		}
+	}
+}
+
+// Each calls fn for every live entry in the table.
+func (tb *Table) Each(fn func(key *ObjString, value Value)) {
+	for i := range tb.entries {
+		e := &tb.entries[i]
+		if e.key != nil {
+			fn(e.key, e.value)
+		}
+	}
+}
+
+// FindString looks a string up by content, which is how the intern table
+// decides whether a new string already has an object.
+func (tb *Table) FindString(chars string, hash uint32) *ObjString {
+	if tb.count == 0 {
+		return nil
+	}
+
+	capacity := uint32(len(tb.entries))
+	index := hash & (capacity - 1)
+	for {
+		e := &tb.entries[index]
+		if e.key == nil {
+			// Stop if we find an empty non-tombstone entry.
+			if e.value.IsNil() {
+				return nil
+			}
+		} else if e.key.Hash == hash && e.key.Chars == chars {
+			return e.key
+		}
+
+		index = (index + 1) & (capacity - 1)
+	}
+}
+
+func (tb *Table) mark(hp *Heap) {
+	for i := range tb.entries {
+		e := &tb.entries[i]
+		if e.key != nil {
+			hp.MarkObject(&e.key.Object)
+		}
+		hp.MarkValue(e.value)
+	}
+}
+
+// removeWhite drops entries whose keys were not marked, so that the intern
+// table does not keep otherwise unreachable strings alive.
+func (tb *Table) removeWhite() {
+	for i := range tb.entries {
+		e := &tb.entries[i]
+		if e.key != nil && !e.key.isMarked {
+			tb.Delete(e.key)
+		}
+	}
+}
+
+// reserve grows the table if one more entry would exceed its load factor.
+func (tb *Table) reserve() {
+	if float64(tb.count+1) > float64(len(tb.entries))*TABLE_MAX_LOAD {
+		tb.adjustCapacity(growCapacity(len(tb.entries)))
+	}
+}
+
+func (tb *Table) adjustCapacity(capacity int) {
+	if tb.heap != nil {
+		tb.heap.growTable(len(tb.entries), capacity)
+	}
+	entries := make([]entry, capacity)
+	for i := range entries {
+		entries[i].value = Nil
+	}
+
+	tb.count = 0
+	for i := range tb.entries {
+		e := &tb.entries[i]
+		if e.key == nil {
+			continue
+		}
+
+		dest := findEntry(entries, e.key)
+		dest.key = e.key
+		dest.value = e.value
+		tb.count++
+	}
+
+	tb.entries = entries
+}
+
+func findEntry(entries []entry, key *ObjString) *entry {
+	capacity := uint32(len(entries))
+	index := key.Hash & (capacity - 1)
+	var tombstone *entry
+
+	for {
+		e := &entries[index]
+		if e.key == nil {
+			if e.value.IsNil() {
+				// Empty entry.
+				if tombstone != nil {
+					return tombstone
+				}
+				return e
+			} else if tombstone == nil {
+				// We found a tombstone.
+				tombstone = e
+			}
+		} else if e.key == key {
+			return e
+		}
+
+		index = (index + 1) & (capacity - 1)
+	}
+}
+
+func growCapacity(capacity int) int {
+	if capacity < 8 {
+		return 8
+	}
+	return capacity * 2
+}
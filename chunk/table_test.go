@@ -0,0 +1,57 @@
+package chunk
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	hp := NewHeap()
+	var tb Table
+	keys := make([]*ObjString, 100)
+	for i := range keys {
+		keys[i] = hp.InternString(fmt.Sprint("key", i))
+		if !tb.Set(keys[i], NewNumber(float64(i))) {
+			t.Fatalf("%s was not reported as new", keys[i].Chars)
+		}
+	}
+
+	// Delete every other key so that the rest sit behind tombstones.
+	for i := 0; i < len(keys); i += 2 {
+		if !tb.Delete(keys[i]) {
+			t.Fatalf("could not delete %s", keys[i].Chars)
+		}
+	}
+	if tb.Delete(keys[0]) {
+		t.Error("deleted a key twice")
+	}
+	for i, key := range keys {
+		value, ok := tb.Get(key)
+		if ok != (i%2 == 1) || ok && value.AsNumber() != float64(i) {
+			t.Errorf("Get(%s) = %v, %v", key.Chars, value, ok)
+		}
+	}
+
+	// Reinsert into the tombstones and grow past the original capacity.
+	if !tb.Set(keys[0], True) {
+		t.Error("a deleted key was not reported as new")
+	}
+	if tb.Set(keys[1], False) {
+		t.Error("overwriting a key reported it as new")
+	}
+	for i := 0; i < 200; i++ {
+		tb.Set(hp.InternString(fmt.Sprint("more", i)), Nil)
+	}
+	if value, ok := tb.Get(keys[0]); !ok || !Equal(value, True) {
+		t.Errorf("Get(%s) = %v, %v after growing", keys[0].Chars, value, ok)
+	}
+	if value, ok := tb.Get(keys[1]); !ok || !Equal(value, False) {
+		t.Errorf("Get(%s) = %v, %v after growing", keys[1].Chars, value, ok)
+	}
+	if _, ok := tb.Get(keys[2]); ok {
+		t.Errorf("%s came back after growing", keys[2].Chars)
+	}
+	if tb.FindString("key3", hashString("key3")) != keys[3] {
+		t.Error("FindString did not return the interned key")
+	}
+}
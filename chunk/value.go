@@ -1,6 +1,9 @@
 package chunk
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+)
 
 type ValType uint8
 
@@ -8,30 +11,26 @@ const (
 	VAL_BOOL ValType = iota
 	VAL_NIL
 	VAL_NUMBER
-	VAL_STRING
 	VAL_OBJECT
 )
 
+// Value is a tagged union rather than a boxed interface{}, so that pushing
+// or reading a number never allocates. Numbers and booleans are stored
+// unboxed in num (a boolean as 0 or 1) and objects in obj.
 type Value struct {
-	lt ValType
-	v  interface{}
+	lt  ValType
+	num float64
+	obj *Object
 }
 
-var Nil = Value{VAL_NIL, nil}
-var False = Value{VAL_BOOL, false}
-var True = Value{VAL_BOOL, true}
-
-func NewString(s string) Value {
-	return Value{
-		lt: VAL_STRING,
-		v:  s,
-	}
-}
+var Nil = Value{lt: VAL_NIL}
+var False = Value{lt: VAL_BOOL, num: 0}
+var True = Value{lt: VAL_BOOL, num: 1}
 
 func NewNumber(f float64) Value {
 	return Value{
-		lt: VAL_NUMBER,
-		v:  f,
+		lt:  VAL_NUMBER,
+		num: f,
 	}
 }
 
@@ -42,20 +41,20 @@ func NewBool(b bool) Value {
 	return False
 }
 
-func (val Value) AsString() string {
-	return val.v.(string)
+func (val Value) AsString() *ObjString {
+	return val.AsObject().AsString()
 }
 
 func (val Value) AsNumber() float64 {
-	return val.v.(float64)
+	return val.num
 }
 
 func (val Value) AsBool() bool {
-	return val.v.(bool)
+	return val.num != 0
 }
 
 func (val Value) IsString() bool {
-	return val.lt == VAL_STRING
+	return val.IsObject() && val.AsObject().IsString()
 }
 
 func (val Value) IsNumber() bool {
@@ -83,8 +82,8 @@ func Equal(a, b Value) bool {
 			return a.AsBool() == b.AsBool()
 		case VAL_NUMBER:
 			return a.AsNumber() == b.AsNumber()
-		case VAL_STRING:
-			return a.AsString() == b.AsString()
+		case VAL_OBJECT:
+			return a.AsObject() == b.AsObject()
 		default:
 			return false
 		}
@@ -92,6 +91,42 @@ func Equal(a, b Value) bool {
 	return false
 }
 
+// Modulo is the remainder of flooring division, so a non-zero result takes
+// the sign of b: -7 % 3 is 2 and 7 % -3 is -2. Like division, it follows
+// IEEE 754 for zero divisors and infinities, so a % 0 is NaN.
+func Modulo(a, b float64) float64 {
+	r := math.Mod(a, b)
+	if r != 0 && (r < 0) != (b < 0) {
+		r += b
+	}
+	return r
+}
+
+// FloorDivide is a / b rounded towards negative infinity: -7 ~/ 2 is -4.
+// Dividing by zero gives an infinity, or NaN for 0 ~/ 0.
+func FloorDivide(a, b float64) float64 {
+	return math.Floor(a / b)
+}
+
+// ToInteger returns the value of a number that is integral and fits in an
+// int64, which is what the bitwise operators accept.
+func ToInteger(val Value) (int64, bool) {
+	if !val.IsNumber() {
+		return 0, false
+	}
+	n := val.AsNumber()
+	if n != math.Trunc(n) || n < math.MinInt64 || n >= -math.MinInt64 {
+		return 0, false
+	}
+	return int64(n), true
+}
+
+// IsShiftCount reports whether n may be the right operand of << or >>.
+// Counts of 64 or more shift every bit out.
+func IsShiftCount(n int64) bool {
+	return n >= 0 && n <= math.MaxUint32
+}
+
 func (val Value) String() string {
 	var str string
 	switch val.lt {
@@ -104,9 +139,7 @@ func (val Value) String() string {
 	case VAL_NIL:
 		str = "nil"
 	case VAL_NUMBER:
-		str = fmt.Sprintf("%g", val.v)
-	case VAL_STRING:
-		str = val.AsString()
+		str = fmt.Sprintf("%g", val.num)
 	case VAL_OBJECT:
 		str = val.AsObject().String()
 	}
@@ -0,0 +1,346 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+)
+
+// VerifyError describes the first problem Verify found in a function.
+type VerifyError struct {
+	Function string
+	Offset   int
+	Message  string
+}
+
+func (e *VerifyError) Error() string {
+	name := e.Function
+	if name == "" {
+		name = "script"
+	}
+	return fmt.Sprintf("invalid bytecode in %s at %04d: %s", name, e.Offset, e.Message)
+}
+
+// Verify checks that function and every function nested in its constants
+// can be run without the vm reading out of bounds: every opcode is known,
+// operands fit the constant table, the upvalues and the live stack, jumps
+// land on instructions, name operands are strings, closure operands are
+// functions, and each instruction sees the same stack depth on every path
+// that reaches it.
+func Verify(function *ObjFunction) error {
+	return verifyFunction(function, 0)
+}
+
+func verifyFunction(function *ObjFunction, depth int) error {
+	if depth == MAX_FUNCTION_DEPTH {
+		return &VerifyError{Function: function.Name, Message: "functions nested too deeply"}
+	}
+	if depth == 0 && function.UpvalueCount != 0 {
+		return &VerifyError{Function: function.Name, Message: "a top-level function cannot have upvalues"}
+	}
+	v := verifier{function: function, ck: &function.Ck}
+	if err := v.verify(); err != nil {
+		return err
+	}
+
+	for _, constant := range function.Ck.Constants {
+		if constant.IsObject() && constant.AsObject().IsFunction() {
+			if err := verifyFunction(constant.AsObject().AsFunction(), depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	function *ObjFunction
+	ck       *Chunk
+	// depths holds the stack depth on entry to each instruction, -1 for
+	// offsets not known to start one.
+	depths []int
+}
+
+type verifyFault struct {
+	offset  int
+	message string
+}
+
+func (v *verifier) fail(offset int, format string, a ...interface{}) {
+	panic(verifyFault{offset, fmt.Sprintf(format, a...)})
+}
+
+func (v *verifier) verify() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(verifyFault)
+			if !ok {
+				panic(r)
+			}
+			err = &VerifyError{Function: v.function.Name, Offset: fault.offset, Message: fault.message}
+		}
+	}()
+
+	if v.function.Arity < 0 || v.function.Arity > math.MaxUint8 {
+		v.fail(0, "arity %d out of range", v.function.Arity)
+	}
+	if len(v.ck.Codes) == 0 {
+		v.fail(0, "no code")
+	}
+
+	// First find where instructions start and check what can be checked
+	// without following control flow.
+	v.depths = make([]int, len(v.ck.Codes))
+	for i := range v.depths {
+		v.depths[i] = -1
+	}
+	starts := make([]bool, len(v.ck.Codes))
+	for offset := 0; offset < len(v.ck.Codes); {
+		starts[offset] = true
+		offset = v.checkInstruction(offset)
+	}
+	for offset := 0; offset < len(v.ck.Codes); offset++ {
+		if starts[offset] && isJump(v.ck.Codes[offset]) {
+			if target := v.jumpTarget(offset); !starts[target] {
+				v.fail(offset, "jump into the middle of an instruction at %04d", target)
+			}
+		}
+	}
+
+	// Then walk every path, starting with the callee and its arguments on
+	// the stack.
+	work := []int{0}
+	v.depths[0] = v.function.Arity + 1
+	for len(work) > 0 {
+		offset := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, next := range v.step(offset) {
+			if next >= len(v.ck.Codes) {
+				v.fail(offset, "execution runs past the end of the code")
+			}
+			after := v.depthAfter(offset)
+			if v.depths[next] == -1 {
+				v.depths[next] = after
+				work = append(work, next)
+			} else if v.depths[next] != after {
+				v.fail(next, "stack depth is %d on one path and %d on another", v.depths[next], after)
+			}
+		}
+	}
+	return nil
+}
+
+// checkInstruction validates the operands of the instruction at offset that
+// do not depend on the stack, and returns the offset of the next one.
+func (v *verifier) checkInstruction(offset int) int {
+	op := v.ck.Codes[offset]
+	if int(op) >= len(opNames) {
+		v.fail(offset, "unknown opcode %d", op)
+	}
+
+	next := offset + 1 + operandSize(op)
+	if (op == OP_CLOSURE || op == OP_CLOSURE_LONG) && next <= len(v.ck.Codes) {
+		function := v.constant(offset, constantOperand(v.ck.Codes, offset))
+		if !function.IsObject() || !function.AsObject().IsFunction() {
+			v.fail(offset, "%s needs a function constant", opNames[op])
+		}
+		next += 2 * function.AsObject().AsFunction().UpvalueCount
+	}
+	if next > len(v.ck.Codes) {
+		v.fail(offset, "%s is cut off by the end of the code", opNames[op])
+	}
+
+	switch op {
+	case OP_CONSTANT:
+		v.constant(offset, int(v.ck.Codes[offset+1]))
+	case OP_CONSTANT_LONG:
+		v.constant(offset, constantOperand(v.ck.Codes, offset))
+	case OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL, OP_CLASS, OP_GET_PROPERTY, OP_SET_PROPERTY,
+		OP_METHOD, OP_GET_SUPER, OP_INVOKE, OP_SUPER_INVOKE, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG,
+		OP_SET_GLOBAL_LONG, OP_CLASS_LONG, OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_METHOD_LONG,
+		OP_GET_SUPER_LONG, OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG:
+		if name := v.constant(offset, constantOperand(v.ck.Codes, offset)); !name.IsString() {
+			v.fail(offset, "%s needs a string constant", opNames[op])
+		}
+	case OP_GET_UPVALUE, OP_SET_UPVALUE:
+		if index := int(v.ck.Codes[offset+1]); index >= v.function.UpvalueCount {
+			v.fail(offset, "upvalue %d out of range", index)
+		}
+	case OP_CLOSURE, OP_CLOSURE_LONG:
+		for i := offset + 1 + operandSize(op); i < next; i += 2 {
+			isLocal, index := v.ck.Codes[i], int(v.ck.Codes[i+1])
+			if isLocal > 1 {
+				v.fail(offset, "bad upvalue kind %d", isLocal)
+			} else if isLocal == 0 && index >= v.function.UpvalueCount {
+				v.fail(offset, "upvalue %d out of range", index)
+			}
+		}
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP, OP_POP_JUMP_IF_FALSE:
+		if target := v.jumpTarget(offset); target < 0 || target >= len(v.ck.Codes) {
+			v.fail(offset, "jump to %04d is outside the code", target)
+		}
+	}
+	return next
+}
+
+func (v *verifier) constant(offset int, index int) Value {
+	if index >= len(v.ck.Constants) {
+		v.fail(offset, "constant %d out of range", index)
+	}
+	return v.ck.Constants[index]
+}
+
+// constantOperand is the constant index of the instruction at offset, in its
+// one-byte or long form.
+func constantOperand(codes []byte, offset int) int {
+	if isLong(codes[offset]) {
+		return int(codes[offset+1])<<16 | int(codes[offset+2])<<8 | int(codes[offset+3])
+	}
+	return int(codes[offset+1])
+}
+
+func isLong(op byte) bool {
+	switch op {
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG, OP_SET_GLOBAL_LONG, OP_CLOSURE_LONG,
+		OP_CLASS_LONG, OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_METHOD_LONG, OP_INVOKE_LONG,
+		OP_GET_SUPER_LONG, OP_SUPER_INVOKE_LONG:
+		return true
+	}
+	return false
+}
+
+func (v *verifier) jumpTarget(offset int) int {
+	return jumpTarget(v.ck.Codes, offset)
+}
+
+// step checks the stack needs of the instruction at offset and returns the
+// offsets execution may continue at.
+func (v *verifier) step(offset int) []int {
+	op := v.ck.Codes[offset]
+	depth := v.depths[offset]
+	if need := stackNeed(op, v.ck.Codes, offset); depth < need {
+		v.fail(offset, "%s needs %d values but the stack holds %d", opNames[op], need, depth)
+	}
+
+	switch op {
+	case OP_GET_LOCAL, OP_SET_LOCAL:
+		if slot := int(v.ck.Codes[offset+1]); slot >= depth {
+			v.fail(offset, "local slot %d is beyond the stack depth %d", slot, depth)
+		}
+	case OP_CLOSURE, OP_CLOSURE_LONG:
+		function := v.ck.Constants[constantOperand(v.ck.Codes, offset)].AsObject().AsFunction()
+		upvalues := offset + 1 + operandSize(op)
+		for i := 0; i < function.UpvalueCount; i++ {
+			isLocal, index := v.ck.Codes[upvalues+2*i], int(v.ck.Codes[upvalues+2*i+1])
+			if isLocal == 1 && index >= depth {
+				v.fail(offset, "captured local slot %d is beyond the stack depth %d", index, depth)
+			}
+		}
+	case OP_RETURN:
+		return nil
+	case OP_JUMP, OP_LOOP:
+		return []int{v.jumpTarget(offset)}
+	case OP_JUMP_IF_FALSE, OP_POP_JUMP_IF_FALSE:
+		return []int{offset + 3, v.jumpTarget(offset)}
+	}
+	return []int{offset + instructionSize(v.ck, offset)}
+}
+
+func (v *verifier) depthAfter(offset int) int {
+	return v.depths[offset] + stackEffect(v.ck.Codes[offset], v.ck.Codes, offset)
+}
+
+func isJump(op byte) bool {
+	return op == OP_JUMP || op == OP_JUMP_IF_FALSE || op == OP_LOOP || op == OP_POP_JUMP_IF_FALSE
+}
+
+func jumpTarget(codes []byte, offset int) int {
+	jump := int(codes[offset+1])<<8 | int(codes[offset+2])
+	if codes[offset] == OP_LOOP {
+		return offset + 3 - jump
+	}
+	return offset + 3 + jump
+}
+
+// instructionSize is the length in bytes of the instruction at offset,
+// which must be well formed.
+func instructionSize(ck *Chunk, offset int) int {
+	op := ck.Codes[offset]
+	size := 1 + operandSize(op)
+	if op == OP_CLOSURE || op == OP_CLOSURE_LONG {
+		size += 2 * ck.Constants[constantOperand(ck.Codes, offset)].AsObject().AsFunction().UpvalueCount
+	}
+	return size
+}
+
+// operandSize is the number of operand bytes after op, not counting the
+// upvalue pairs that follow OP_CLOSURE.
+func operandSize(op byte) int {
+	switch op {
+	case OP_CONSTANT, OP_DEFINE_GLOBAL, OP_GET_GLOBAL, OP_SET_GLOBAL, OP_GET_LOCAL, OP_SET_LOCAL,
+		OP_CALL, OP_CLOSURE, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CLASS, OP_GET_PROPERTY,
+		OP_SET_PROPERTY, OP_METHOD, OP_GET_SUPER:
+		return 1
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP, OP_INVOKE, OP_SUPER_INVOKE, OP_POP_JUMP_IF_FALSE:
+		return 2
+	case OP_CONSTANT_LONG, OP_DEFINE_GLOBAL_LONG, OP_GET_GLOBAL_LONG, OP_SET_GLOBAL_LONG, OP_CLOSURE_LONG,
+		OP_CLASS_LONG, OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_METHOD_LONG, OP_GET_SUPER_LONG:
+		return 3
+	case OP_INVOKE_LONG, OP_SUPER_INVOKE_LONG:
+		return 4
+	}
+	return 0
+}
+
+// stackNeed is how many values the instruction at offset reads from the
+// stack.
+func stackNeed(op byte, codes []byte, offset int) int {
+	switch op {
+	case OP_NEGATE, OP_NOT, OP_PRINT, OP_POP, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_SET_LOCAL,
+		OP_SET_UPVALUE, OP_JUMP_IF_FALSE, OP_CLOSE_UPVALUE, OP_GET_PROPERTY, OP_RETURN,
+		OP_DEFINE_GLOBAL_LONG, OP_SET_GLOBAL_LONG, OP_POP_JUMP_IF_FALSE, OP_BIT_NOT, OP_GET_PROPERTY_LONG:
+		return 1
+	case OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE, OP_EQUAL, OP_GREATER, OP_LESS,
+		OP_SET_PROPERTY, OP_METHOD, OP_INHERIT, OP_GET_SUPER, OP_NOT_EQUAL, OP_GREATER_EQUAL,
+		OP_LESS_EQUAL, OP_MODULO, OP_FLOOR_DIVIDE, OP_POWER, OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR,
+		OP_SHIFT_LEFT, OP_SHIFT_RIGHT, OP_SET_PROPERTY_LONG, OP_METHOD_LONG, OP_GET_SUPER_LONG:
+		return 2
+	case OP_CALL:
+		return int(codes[offset+1]) + 1
+	case OP_INVOKE:
+		return int(codes[offset+2]) + 1
+	case OP_SUPER_INVOKE:
+		return int(codes[offset+2]) + 2
+	case OP_INVOKE_LONG:
+		return int(codes[offset+4]) + 1
+	case OP_SUPER_INVOKE_LONG:
+		return int(codes[offset+4]) + 2
+	}
+	return 0
+}
+
+// stackEffect is the change in stack depth caused by the instruction at
+// offset.
+func stackEffect(op byte, codes []byte, offset int) int {
+	switch op {
+	case OP_CONSTANT, OP_NIL, OP_FALSE, OP_TRUE, OP_GET_GLOBAL, OP_GET_LOCAL, OP_GET_UPVALUE,
+		OP_CLOSURE, OP_CLASS, OP_CONSTANT_LONG, OP_GET_GLOBAL_LONG, OP_CLOSURE_LONG, OP_CLASS_LONG:
+		return 1
+	case OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE, OP_EQUAL, OP_GREATER, OP_LESS, OP_PRINT,
+		OP_POP, OP_DEFINE_GLOBAL, OP_CLOSE_UPVALUE, OP_SET_PROPERTY, OP_METHOD, OP_INHERIT,
+		OP_GET_SUPER, OP_RETURN, OP_DEFINE_GLOBAL_LONG, OP_NOT_EQUAL, OP_GREATER_EQUAL, OP_LESS_EQUAL,
+		OP_POP_JUMP_IF_FALSE, OP_MODULO, OP_FLOOR_DIVIDE, OP_POWER, OP_BIT_AND, OP_BIT_OR, OP_BIT_XOR,
+		OP_SHIFT_LEFT, OP_SHIFT_RIGHT, OP_SET_PROPERTY_LONG, OP_METHOD_LONG, OP_GET_SUPER_LONG:
+		return -1
+	case OP_CALL:
+		return -int(codes[offset+1])
+	case OP_INVOKE:
+		return -int(codes[offset+2])
+	case OP_SUPER_INVOKE:
+		return -int(codes[offset+2]) - 1
+	case OP_INVOKE_LONG:
+		return -int(codes[offset+4])
+	case OP_SUPER_INVOKE_LONG:
+		return -int(codes[offset+4]) - 1
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package chunk
+
+import "testing"
+
+func TestVerifyRejects(t *testing.T) {
+	name := NewObject(NewString("x", hashString("x")))
+	for _, tc := range []struct {
+		what      string
+		codes     []byte
+		constants []Value
+	}{
+		{"unknown opcode", []byte{0xfe}, nil},
+		{"constant index", []byte{OP_CONSTANT, 3, OP_RETURN}, []Value{Nil}},
+		{"global name type", []byte{OP_GET_GLOBAL, 0, OP_RETURN}, []Value{NewNumber(1)}},
+		{"jump past the end", []byte{OP_JUMP, 0, 9, OP_NIL, OP_RETURN}, nil},
+		{"jump into an operand", []byte{OP_JUMP, 0, 1, OP_CONSTANT, 0, OP_RETURN}, []Value{Nil}},
+		{"local slot", []byte{OP_GET_LOCAL, 4, OP_RETURN}, nil},
+		{"underflow", []byte{OP_POP, OP_POP, OP_RETURN}, nil},
+		{"unbalanced branches", []byte{OP_TRUE, OP_JUMP_IF_FALSE, 0, 1, OP_NIL, OP_RETURN}, nil},
+		{"falls off the end", []byte{OP_NIL, OP_POP}, nil},
+		{"truncated operand", []byte{OP_NIL, OP_SET_GLOBAL}, []Value{name}},
+	} {
+		function := &ObjFunction{}
+		function.Ck.Codes = tc.codes
+		function.Ck.Constants = tc.constants
+		if err := Verify(function); err == nil {
+			t.Errorf("%s: expected Verify to fail", tc.what)
+		}
+	}
+
+	// A script has no enclosing function to capture upvalues from.
+	function := &ObjFunction{UpvalueCount: 1}
+	function.Ck.Codes = []byte{OP_GET_UPVALUE, 0, OP_RETURN}
+	if err := Verify(function); err == nil {
+		t.Error("script upvalue: expected Verify to fail")
+	}
+
+	function = &ObjFunction{}
+	function.Ck.Codes = []byte{OP_CONSTANT, 0, OP_SET_GLOBAL, 0, OP_RETURN}
+	function.Ck.Constants = []Value{name}
+	if err := Verify(function); err != nil {
+		t.Errorf("unexpected error for valid code: %v", err)
+	}
+}
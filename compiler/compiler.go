@@ -1,11 +1,8 @@
 package compiler
 
 import (
-	"fmt"
 	"github.com/Roderland/glox-vm/chunk"
-	"github.com/Roderland/glox-vm/utils"
 	"math"
-	"os"
 )
 
 type parser struct {
@@ -13,6 +10,9 @@ type parser struct {
 	previous  *token
 	hadError  bool
 	panicMode bool
+	// diagnostics holds every error and warning found so far, in source
+	// order.
+	diagnostics []Diagnostic
 }
 
 const MAX_LOCAL_COUNT = math.MaxUint8 + 1
@@ -23,462 +23,786 @@ type compiler struct {
 	functionType chunk.FunType
 	locals       [MAX_LOCAL_COUNT]local
 	localCount   int
+	upvalues     [MAX_LOCAL_COUNT]upvalue
 	scopeDepth   int
+	loops        []loop
+
+	// literal is the last literal emitted, and jumpTarget the offset of the
+	// last jump target; constant folding must not reach back past it.
+	literal    literalCode
+	jumpTarget int
+	// constants indexes the number and string constants for reuse.
+	constants map[constantKey]int
 }
 
-func newCompiler(functionType chunk.FunType) *compiler {
+func (c *Compiler) newCompiler(functionType chunk.FunType) *compiler {
 	cpl := compiler{
-		enclosing:    cpl,
+		enclosing:    c.cpl,
 		function:     &chunk.ObjFunction{},
 		functionType: functionType,
 		locals:       [MAX_LOCAL_COUNT]local{},
 		localCount:   0,
+		upvalues:     [MAX_LOCAL_COUNT]upvalue{},
 		scopeDepth:   0,
+		constants:    make(map[constantKey]int),
 	}
 
 	if functionType != chunk.SCRIPT {
-		cpl.function.Name = prs.previous.lexeme
+		cpl.function.Name = c.prs.previous.lexeme
 	}
 
 	cpl.locals[cpl.localCount].depth = 0
-	cpl.locals[cpl.localCount].name.lexeme = ""
+	if functionType != chunk.FUNCTION && functionType != chunk.SCRIPT {
+		cpl.locals[cpl.localCount].name.lexeme = "this"
+	} else {
+		cpl.locals[cpl.localCount].name.lexeme = ""
+	}
 	cpl.localCount++
 	return &cpl
 }
 
 type local struct {
-	name  token
-	depth int
+	name       token
+	depth      int
+	isCaptured bool
+}
+
+// loop is an enclosing loop that break and continue statements refer to.
+type loop struct {
+	// start is where continue jumps to, and scopeDepth the depth of the
+	// scope the loop was entered in.
+	start      int
+	scopeDepth int
+	breaks     []int
+}
+
+type upvalue struct {
+	index   uint8
+	isLocal bool
+}
+
+type classCompiler struct {
+	enclosing     *classCompiler
+	hasSuperclass bool
+}
+
+// Compiler holds the state of one compilation. Separate Compilers share
+// nothing, so they may run in parallel as long as each uses its own heap.
+type Compiler struct {
+	scn          scanner
+	prs          parser
+	hp           *chunk.Heap
+	disAsm       bool
+	reporter     Reporter
+	repl         bool
+	firstLine    int
+	optimize     bool
+	cpl          *compiler
+	currentClass *classCompiler
+	// topLevel is set while the next declaration is one read directly by
+	// Compile's loop, whose expression statements the REPL prints.
+	topLevel bool
+}
+
+// New returns a Compiler that allocates functions and constants in heap.
+func New(heap *chunk.Heap, disAsmMode bool) *Compiler {
+	return &Compiler{
+		hp:     heap,
+		disAsm: disAsmMode,
+	}
+}
+
+// SetReporter makes the Compiler pass each diagnostic to reporter as soon as
+// it is found, in addition to returning it from Compile.
+func (c *Compiler) SetReporter(reporter Reporter) {
+	c.reporter = reporter
 }
 
-var scn scanner
-var prs parser
+// SetREPL makes top-level expression statements print their value, and lets
+// the last one leave out its semicolon.
+func (c *Compiler) SetREPL(repl bool) {
+	c.repl = repl
+}
 
-// var cck *chunk.Chunk
-var cpl *compiler
+// SetOptimize runs chunk.Optimize over every function compiled without
+// errors.
+func (c *Compiler) SetOptimize(optimize bool) {
+	c.optimize = optimize
+}
+
+// SetFirstLine numbers the lines of the next source passed to Compile from
+// line, so that entries typed into a REPL can each have lines of their own.
+func (c *Compiler) SetFirstLine(line int) {
+	c.firstLine = line
+}
 
-func Compile(source []byte, disAsmMode bool) (*chunk.ObjFunction, bool) {
-	scn.init(source)
-	// cck = chunk.NewChunk()
-	cpl = newCompiler(chunk.SCRIPT)
-	prs.hadError = false
-	prs.panicMode = false
-	advance()
+// Compile is a shorthand for New(heap, disAsmMode).Compile(source).
+func Compile(source []byte, heap *chunk.Heap, disAsmMode bool) (*chunk.ObjFunction, []Diagnostic) {
+	return New(heap, disAsmMode).Compile(source)
+}
+
+// Compile compiles source into a top-level script function allocated in
+// the heap, along with every diagnostic found on the way. If any of them is
+// an error the function is nil.
+func (c *Compiler) Compile(source []byte) (fn *chunk.ObjFunction, diagnostics []Diagnostic) {
+	c.hp.PushRoots(c.markCompilerRoots)
+	defer c.hp.PopRoots()
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isOOM := r.(chunk.OutOfMemory); !isOOM {
+				panic(r)
+			}
+			c.prs.panicMode = false
+			c.errorAtCurrent("Out of memory.")
+			fn, diagnostics = nil, c.prs.diagnostics
+		}
+	}()
+
+	c.scn.init(source)
+	if c.firstLine > 0 {
+		c.scn.line = c.firstLine
+	}
+	// Drop anything left behind by an earlier call that ran out of memory.
+	c.cpl = nil
+	c.cpl = c.newCompiler(chunk.SCRIPT)
+	c.currentClass = nil
+	c.prs = parser{}
+	c.advance()
 
-	for !match(TOKEN_EOF) {
-		declaration()
+	for !c.match(TOKEN_EOF) {
+		c.topLevel = true
+		c.declaration()
 	}
 
-	return endCompile(disAsmMode), !prs.hadError
+	function := c.endCompile(c.disAsm)
+	if c.prs.hadError {
+		return nil, c.prs.diagnostics
+	}
+	return function, c.prs.diagnostics
 }
 
-func declaration() {
-	if match(TOKEN_VAR) {
-		varDeclaration()
-	} else if match(TOKEN_FUN) {
-		funDeclaration()
+func (c *Compiler) declaration() {
+	topLevel := c.topLevel
+	c.topLevel = false
+	if c.match(TOKEN_CLASS) {
+		c.classDeclaration()
+	} else if c.match(TOKEN_VAR) {
+		c.varDeclaration()
+	} else if c.match(TOKEN_FUN) {
+		c.funDeclaration()
 	} else {
-		statement()
+		c.topLevel = topLevel
+		c.statement()
+	}
+
+	if c.prs.panicMode {
+		c.synchronize()
+	}
+}
+
+func (c *Compiler) classDeclaration() {
+	c.consume(TOKEN_IDENTIFIER, "Expect class name.")
+	className := c.prs.previous
+	nameConstant := c.identifierConstant(c.prs.previous)
+	c.declareVariable()
+
+	c.emitConstantOp(c.prs.previous, chunk.OP_CLASS, chunk.OP_CLASS_LONG, nameConstant)
+	c.defineVariable(nameConstant)
+
+	c.currentClass = &classCompiler{enclosing: c.currentClass}
+
+	if c.match(TOKEN_LESS) {
+		c.consume(TOKEN_IDENTIFIER, "Expect superclass name.")
+		c.variable(false)
+
+		if className.lexeme == c.prs.previous.lexeme {
+			c.errorAtPrevious("A class can't inherit from itself.")
+		}
+
+		c.beginScope()
+		c.addLocal(c.syntheticToken("super"))
+		c.defineVariable(0)
+
+		c.namedVariable(className, false)
+		c.emitBytes(chunk.OP_INHERIT)
+		c.currentClass.hasSuperclass = true
 	}
 
-	if prs.panicMode {
-		synchronize()
+	c.namedVariable(className, false)
+	c.consume(TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	for !c.check(TOKEN_RIGHT_BRACE) && !c.check(TOKEN_EOF) {
+		c.method()
 	}
+	c.consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	c.emitBytes(chunk.OP_POP)
+
+	if c.currentClass.hasSuperclass {
+		c.endScope()
+	}
+
+	c.currentClass = c.currentClass.enclosing
 }
 
-func funDeclaration() {
-	global := parseVariable("Expect function name.")
-	markInitialized()
-	function(chunk.FUNCTION)
-	defineVariable(global)
+func (c *Compiler) method() {
+	c.consume(TOKEN_IDENTIFIER, "Expect method name.")
+	constant := c.identifierConstant(c.prs.previous)
+
+	ft := chunk.METHOD
+	if c.prs.previous.lexeme == "init" {
+		ft = chunk.INITIALIZER
+	}
+	c.function(ft)
+
+	c.emitConstantOp(c.prs.previous, chunk.OP_METHOD, chunk.OP_METHOD_LONG, constant)
 }
 
-func function(ft chunk.FunType) {
-	cpl = newCompiler(ft)
-	beginScope()
-	consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+func (c *Compiler) funDeclaration() {
+	global := c.parseVariable("Expect function name.")
+	c.markInitialized()
+	c.function(chunk.FUNCTION)
+	c.defineVariable(global)
+}
 
-	if !check(TOKEN_RIGHT_PAREN) {
-		cpl.function.Arity++
-		if cpl.function.Arity > 255 {
-			errorAtCurrent("Can't have more than 255 parameters.")
+func (c *Compiler) function(ft chunk.FunType) {
+	c.cpl = c.newCompiler(ft)
+	c.beginScope()
+	c.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+
+	if !c.check(TOKEN_RIGHT_PAREN) {
+		c.cpl.function.Arity++
+		if c.cpl.function.Arity > 255 {
+			c.errorAtCurrent("Can't have more than 255 parameters.")
 		}
-		constant := parseVariable("Expect parameter name.")
-		defineVariable(constant)
+		constant := c.parseVariable("Expect parameter name.")
+		c.defineVariable(constant)
 
-		for match(TOKEN_COMMA) {
-			cpl.function.Arity++
-			if cpl.function.Arity > 255 {
-				errorAtCurrent("Can't have more than 255 parameters.")
+		for c.match(TOKEN_COMMA) {
+			c.cpl.function.Arity++
+			if c.cpl.function.Arity > 255 {
+				c.errorAtCurrent("Can't have more than 255 parameters.")
 			}
-			constant := parseVariable("Expect parameter name.")
-			defineVariable(constant)
+			constant := c.parseVariable("Expect parameter name.")
+			c.defineVariable(constant)
 		}
 	}
 
-	consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
-	consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
-	block()
+	c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	c.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	c.block()
+
+	// c.endScope()
+	inner := c.cpl
+	fun := c.endCompile(c.disAsm)
+	val := chunk.NewObject(&fun.Object)
+	c.emitConstantOp(c.prs.previous, chunk.OP_CLOSURE, chunk.OP_CLOSURE_LONG, c.makeConstant(val))
 
-	// endScope()
-	fun := endCompile(true)
-	val := chunk.NewObject(chunk.NewFunction(*fun))
-	emitBytes(chunk.OP_CONSTANT, makeConstant(val))
+	for i := 0; i < fun.UpvalueCount; i++ {
+		if inner.upvalues[i].isLocal {
+			c.emitBytes(1)
+		} else {
+			c.emitBytes(0)
+		}
+		c.emitBytes(inner.upvalues[i].index)
+	}
 }
 
-func varDeclaration() {
-	global := parseVariable("Expect variable name.")
+func (c *Compiler) varDeclaration() {
+	global := c.parseVariable("Expect variable name.")
 
-	if match(TOKEN_EQUAL) {
-		expression()
+	if c.match(TOKEN_EQUAL) {
+		c.expression()
 	} else {
-		emitBytes(chunk.OP_NIL)
+		c.emitBytes(chunk.OP_NIL)
 	}
-	consume(TOKEN_SEMICOLON, "Expect ';' after variable declaration.")
+	c.consume(TOKEN_SEMICOLON, "Expect ';' after variable declaration.")
 
-	defineVariable(global)
+	c.defineVariable(global)
 }
 
-func parseVariable(errorMessage string) byte {
-	consume(TOKEN_IDENTIFIER, errorMessage)
-	declareVariable()
-	if cpl.scopeDepth > 0 {
+func (c *Compiler) parseVariable(errorMessage string) int {
+	c.consume(TOKEN_IDENTIFIER, errorMessage)
+	c.declareVariable()
+	if c.cpl.scopeDepth > 0 {
 		return 0
 	}
-	return identifierConstant(prs.previous)
+	return c.identifierConstant(c.prs.previous)
 }
 
-func declareVariable() {
-	if cpl.scopeDepth == 0 {
+func (c *Compiler) declareVariable() {
+	if c.cpl.scopeDepth == 0 {
 		return
 	}
 
-	name := *prs.previous
+	name := *c.prs.previous
 
-	for i := cpl.localCount - 1; i >= 0; i-- {
-		lc := &cpl.locals[i]
-		if lc.depth != -1 && lc.depth < cpl.scopeDepth {
+	for i := c.cpl.localCount - 1; i >= 0; i-- {
+		lc := &c.cpl.locals[i]
+		if lc.depth != -1 && lc.depth < c.cpl.scopeDepth {
 			break
 		}
 		if lc.name.lexeme == name.lexeme {
-			errorAtPrevious("Already a variable with this name in this scope.")
+			c.errorAt(c.prs.previous, "Already a variable with this name in this scope.",
+				noteAt(&lc.name, "previous declaration here"))
 		}
 	}
-	addLocal(name)
+	c.addLocal(name)
 }
 
-func addLocal(tk token) {
-	if cpl.localCount == MAX_LOCAL_COUNT {
-		errorAtPrevious("Too many local variables in function.")
+func (c *Compiler) addLocal(tk token) {
+	if c.cpl.localCount == MAX_LOCAL_COUNT {
+		c.errorAtPrevious("Too many local variables in function.")
 	}
-	cpl.locals[cpl.localCount].name = tk
-	cpl.locals[cpl.localCount].depth = -1
-	cpl.localCount++
+	c.cpl.locals[c.cpl.localCount].name = tk
+	c.cpl.locals[c.cpl.localCount].depth = -1
+	c.cpl.locals[c.cpl.localCount].isCaptured = false
+	c.cpl.localCount++
 }
 
-func identifierConstant(varName *token) uint8 {
-	return makeConstant(chunk.NewString(varName.lexeme))
+func (c *Compiler) syntheticToken(text string) token {
+	return token{
+		tp:     TOKEN_IDENTIFIER,
+		lexeme: text,
+		line:   c.prs.previous.line,
+		column: c.prs.previous.column,
+	}
 }
 
-func defineVariable(global uint8) {
-	if cpl.scopeDepth > 0 {
-		markInitialized()
+func (c *Compiler) identifierConstant(varName *token) int {
+	return c.makeConstant(chunk.NewObject(&c.hp.InternString(varName.lexeme).Object))
+}
+
+func (c *Compiler) defineVariable(global int) {
+	if c.cpl.scopeDepth > 0 {
+		c.markInitialized()
 		return
 	}
-	emitBytes(chunk.OP_DEFINE_GLOBAL, global)
+	c.emitConstantOp(c.prs.previous, chunk.OP_DEFINE_GLOBAL, chunk.OP_DEFINE_GLOBAL_LONG, global)
 }
 
-func markInitialized() {
-	if cpl.scopeDepth == 0 {
+func (c *Compiler) markInitialized() {
+	if c.cpl.scopeDepth == 0 {
 		return
 	}
-	cpl.locals[cpl.localCount-1].depth = cpl.scopeDepth
-}
-
-func statement() {
-	if match(TOKEN_PRINT) {
-		printStatement()
-	} else if match(TOKEN_LEFT_BRACE) {
-		beginScope()
-		block()
-		endScope()
-	} else if match(TOKEN_IF) {
-		ifStatement()
-	} else if match(TOKEN_WHILE) {
-		whileStatement()
-	} else if match(TOKEN_FOR) {
-		forStatement()
-	} else if match(TOKEN_RETURN) {
-		returnStatement()
+	c.cpl.locals[c.cpl.localCount-1].depth = c.cpl.scopeDepth
+}
+
+func (c *Compiler) statement() {
+	topLevel := c.topLevel
+	c.topLevel = false
+	if c.match(TOKEN_PRINT) {
+		c.printStatement()
+	} else if c.match(TOKEN_LEFT_BRACE) {
+		c.beginScope()
+		c.block()
+		c.endScope()
+	} else if c.match(TOKEN_IF) {
+		c.ifStatement()
+	} else if c.match(TOKEN_WHILE) {
+		c.whileStatement()
+	} else if c.match(TOKEN_FOR) {
+		c.forStatement()
+	} else if c.match(TOKEN_RETURN) {
+		c.returnStatement()
+	} else if c.match(TOKEN_BREAK) {
+		c.breakStatement()
+	} else if c.match(TOKEN_CONTINUE) {
+		c.continueStatement()
 	} else {
-		expressionStatement()
+		c.expressionStatement(topLevel)
 	}
 }
 
-func returnStatement() {
-	if cpl.functionType == chunk.SCRIPT {
-		errorAtPrevious("Can't return from top-level code.")
+func (c *Compiler) returnStatement() {
+	if c.cpl.functionType == chunk.SCRIPT {
+		c.errorAtPrevious("Can't return from top-level code.")
 	}
 
-	if match(TOKEN_SEMICOLON) {
-		emitReturn()
+	if c.match(TOKEN_SEMICOLON) {
+		c.emitReturn()
 	} else {
-		expression()
-		consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
-		emitBytes(chunk.OP_RETURN)
+		if c.cpl.functionType == chunk.INITIALIZER {
+			c.errorAtPrevious("Can't return a value from an initializer.")
+		}
+
+		c.expression()
+		c.consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
+		c.emitBytes(chunk.OP_RETURN)
 	}
 }
 
-func forStatement() {
-	beginScope()
-	consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
-	if match(TOKEN_SEMICOLON) {
+func (c *Compiler) forStatement() {
+	c.beginScope()
+	c.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if c.match(TOKEN_SEMICOLON) {
 		// No initializer.
-	} else if match(TOKEN_VAR) {
-		varDeclaration()
+	} else if c.match(TOKEN_VAR) {
+		c.varDeclaration()
 	} else {
-		expressionStatement()
+		c.expressionStatement(false)
 	}
 
-	loopStart := len(currentChunk().Codes)
+	loopStart := len(c.currentChunk().Codes)
 	incrStart := loopStart
 	exitJump := -1
-	if !match(TOKEN_SEMICOLON) {
-		expression()
-		consume(TOKEN_SEMICOLON, "Expect ';'.")
+	if !c.match(TOKEN_SEMICOLON) {
+		c.expression()
+		c.consume(TOKEN_SEMICOLON, "Expect ';'.")
 
-		exitJump = emitJump(chunk.OP_JUMP_IF_FALSE)
-		emitBytes(chunk.OP_POP)
+		exitJump = c.emitJump(chunk.OP_JUMP_IF_FALSE)
+		c.emitBytes(chunk.OP_POP)
 	}
 
-	if !match(TOKEN_RIGHT_PAREN) {
-		bodyJump := emitJump(chunk.OP_JUMP)
-		incrStart = len(currentChunk().Codes)
-		expression()
-		emitBytes(chunk.OP_POP)
-		consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	if !c.match(TOKEN_RIGHT_PAREN) {
+		bodyJump := c.emitJump(chunk.OP_JUMP)
+		incrStart = len(c.currentChunk().Codes)
+		c.expression()
+		c.emitBytes(chunk.OP_POP)
+		c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
 
-		emitLoop(loopStart)
+		c.emitLoop(loopStart)
 		loopStart = incrStart
-		patchJump(bodyJump)
+		c.patchJump(bodyJump)
 	}
 
-	statement()
-	emitLoop(incrStart)
+	c.beginLoop(incrStart)
+	c.statement()
+	c.emitLoop(incrStart)
 
 	if exitJump != -1 {
-		patchJump(exitJump)
-		emitBytes(chunk.OP_POP)
+		c.patchJump(exitJump)
+		c.emitBytes(chunk.OP_POP)
+	}
+	c.endLoop()
+
+	c.endScope()
+}
+
+func (c *Compiler) whileStatement() {
+	c.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	loopStart := len(c.currentChunk().Codes)
+	c.expression()
+	c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	exitJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	c.emitBytes(chunk.OP_POP)
+	c.beginLoop(loopStart)
+	c.statement()
+	c.emitLoop(loopStart)
+
+	c.patchJump(exitJump)
+	c.emitBytes(chunk.OP_POP)
+	c.endLoop()
+}
+
+func (c *Compiler) beginLoop(start int) {
+	c.cpl.loops = append(c.cpl.loops, loop{start: start, scopeDepth: c.cpl.scopeDepth})
+}
+
+// endLoop points the loop's break statements at the current offset.
+func (c *Compiler) endLoop() {
+	lp := c.cpl.loops[len(c.cpl.loops)-1]
+	c.cpl.loops = c.cpl.loops[:len(c.cpl.loops)-1]
+	for _, jump := range lp.breaks {
+		c.patchJump(jump)
 	}
+}
 
-	endScope()
+func (c *Compiler) breakStatement() {
+	if len(c.cpl.loops) == 0 {
+		c.errorAtPrevious("Can't use 'break' outside of a loop.")
+	}
+	c.consume(TOKEN_SEMICOLON, "Expect ';' after 'break'.")
+	if len(c.cpl.loops) == 0 {
+		return
+	}
+
+	lp := &c.cpl.loops[len(c.cpl.loops)-1]
+	c.discardLocals(lp.scopeDepth)
+	lp.breaks = append(lp.breaks, c.emitJump(chunk.OP_JUMP))
 }
 
-func whileStatement() {
-	consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
-	loopStart := len(currentChunk().Codes)
-	expression()
-	consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+func (c *Compiler) continueStatement() {
+	if len(c.cpl.loops) == 0 {
+		c.errorAtPrevious("Can't use 'continue' outside of a loop.")
+	}
+	c.consume(TOKEN_SEMICOLON, "Expect ';' after 'continue'.")
+	if len(c.cpl.loops) == 0 {
+		return
+	}
 
-	exitJump := emitJump(chunk.OP_JUMP_IF_FALSE)
-	emitBytes(chunk.OP_POP)
-	statement()
-	emitLoop(loopStart)
+	lp := c.cpl.loops[len(c.cpl.loops)-1]
+	c.discardLocals(lp.scopeDepth)
+	c.emitLoop(lp.start)
+}
 
-	patchJump(exitJump)
-	emitBytes(chunk.OP_POP)
+// discardLocals emits code to pop the locals declared deeper than depth,
+// while leaving them in scope for the code that follows.
+func (c *Compiler) discardLocals(depth int) {
+	for i := c.cpl.localCount - 1; i >= 0 && c.cpl.locals[i].depth > depth; i-- {
+		if c.cpl.locals[i].isCaptured {
+			c.emitBytes(chunk.OP_CLOSE_UPVALUE)
+		} else {
+			c.emitBytes(chunk.OP_POP)
+		}
+	}
 }
 
-func emitLoop(loopStart int) {
-	emitBytes(chunk.OP_LOOP)
+func (c *Compiler) emitLoop(loopStart int) {
+	c.emitBytes(chunk.OP_LOOP)
 
-	offset := len(currentChunk().Codes) - loopStart + 2
+	offset := len(c.currentChunk().Codes) - loopStart + 2
 	if offset > math.MaxUint16 {
-		errorAtPrevious("Loop body too large.")
+		c.errorAtPrevious("Loop body too large.")
 	}
 
-	emitBytes(uint8(offset>>8) & 0xff)
-	emitBytes(uint8(offset) & 0xff)
+	c.emitBytes(uint8(offset>>8) & 0xff)
+	c.emitBytes(uint8(offset) & 0xff)
 }
 
-func ifStatement() {
-	consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
-	expression()
-	consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+func (c *Compiler) ifStatement() {
+	c.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	c.expression()
+	c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
 
-	thenJump := emitJump(chunk.OP_JUMP_IF_FALSE)
-	emitBytes(chunk.OP_POP)
-	statement()
+	thenJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	c.emitBytes(chunk.OP_POP)
+	c.statement()
 
-	elseJump := emitJump(chunk.OP_JUMP)
-	patchJump(thenJump)
-	emitBytes(chunk.OP_POP)
+	elseJump := c.emitJump(chunk.OP_JUMP)
+	c.patchJump(thenJump)
+	c.emitBytes(chunk.OP_POP)
 
-	if match(TOKEN_ELSE) {
-		statement()
+	if c.match(TOKEN_ELSE) {
+		c.statement()
 	}
-	patchJump(elseJump)
+	c.patchJump(elseJump)
 }
 
-func emitJump(instruction byte) int {
-	emitBytes(instruction, 0xff, 0xff)
-	return len(currentChunk().Codes) - 2
+func (c *Compiler) emitJump(instruction byte) int {
+	c.emitBytes(instruction, 0xff, 0xff)
+	return len(c.currentChunk().Codes) - 2
 }
 
-func patchJump(offset int) {
-	jump := len(currentChunk().Codes) - offset - 2
+func (c *Compiler) patchJump(offset int) {
+	jump := len(c.currentChunk().Codes) - offset - 2
 	if jump > math.MaxUint16 {
-		errorAtPrevious("Too much code to jump over.")
+		c.errorAtPrevious("Too much code to jump over.")
 	}
 
-	currentChunk().Codes[offset] = byte((jump >> 8) & 0xff)
-	currentChunk().Codes[offset+1] = byte(jump & 0xff)
+	c.currentChunk().Codes[offset] = byte((jump >> 8) & 0xff)
+	c.currentChunk().Codes[offset+1] = byte(jump & 0xff)
+	c.cpl.jumpTarget = len(c.currentChunk().Codes)
 }
 
-func beginScope() {
-	cpl.scopeDepth++
+func (c *Compiler) beginScope() {
+	c.cpl.scopeDepth++
 }
-func endScope() {
-	cpl.scopeDepth--
+func (c *Compiler) endScope() {
+	c.cpl.scopeDepth--
 
-	for cpl.localCount > 0 && cpl.locals[cpl.localCount-1].depth > cpl.scopeDepth {
-		emitBytes(chunk.OP_POP)
-		cpl.localCount--
+	for c.cpl.localCount > 0 && c.cpl.locals[c.cpl.localCount-1].depth > c.cpl.scopeDepth {
+		if c.cpl.locals[c.cpl.localCount-1].isCaptured {
+			c.emitBytes(chunk.OP_CLOSE_UPVALUE)
+		} else {
+			c.emitBytes(chunk.OP_POP)
+		}
+		c.cpl.localCount--
 	}
 }
-func block() {
-	for !check(TOKEN_EOF) && !check(TOKEN_RIGHT_BRACE) {
-		declaration()
+func (c *Compiler) block() {
+	for !c.check(TOKEN_EOF) && !c.check(TOKEN_RIGHT_BRACE) {
+		c.declaration()
 	}
-	consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	c.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
 }
 
-func expressionStatement() {
-	expression()
-	consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
-	emitBytes(chunk.OP_POP)
+// expressionStatement compiles an expression statement, which prints its
+// value instead of discarding it in the REPL if topLevel is set.
+func (c *Compiler) expressionStatement(topLevel bool) {
+	c.expression()
+	if c.repl && topLevel {
+		if !c.check(TOKEN_EOF) {
+			c.consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
+		}
+		c.emitBytes(chunk.OP_PRINT)
+		return
+	}
+	c.consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
+	c.emitBytes(chunk.OP_POP)
 }
 
-func printStatement() {
-	expression()
-	consume(TOKEN_SEMICOLON, "Expect ';' after value.")
-	emitBytes(chunk.OP_PRINT)
+func (c *Compiler) printStatement() {
+	c.expression()
+	c.consume(TOKEN_SEMICOLON, "Expect ';' after value.")
+	c.emitBytes(chunk.OP_PRINT)
 }
 
-func match(tp tokenType) bool {
-	if check(tp) {
-		advance()
+func (c *Compiler) match(tp tokenType) bool {
+	if c.check(tp) {
+		c.advance()
 		return true
 	}
 	return false
 }
 
-func check(tp tokenType) bool {
-	return prs.current.tp == tp
+func (c *Compiler) check(tp tokenType) bool {
+	return c.prs.current.tp == tp
 }
 
-func endCompile(disAsmMode bool) *chunk.ObjFunction {
-	emitReturn()
-	function := cpl.function
+func (c *Compiler) endCompile(disAsmMode bool) *chunk.ObjFunction {
+	c.emitReturn()
+	function := c.cpl.function
+	if c.optimize && !c.prs.hadError {
+		chunk.Optimize(c.currentChunk())
+	}
 	if disAsmMode {
-		if !prs.hadError {
-			chunk.DisAsmChunk(currentChunk(), function.GetName())
+		if !c.prs.hadError {
+			chunk.DisAsmChunk(c.currentChunk(), function.GetName())
 		}
 	}
-	cpl = cpl.enclosing
+	c.hp.Allocate(chunk.NewFunction(function))
+	c.cpl = c.cpl.enclosing
 	return function
 }
 
-func emitReturn() {
-	emitBytes(chunk.OP_NIL)
-	emitBytes(chunk.OP_RETURN)
+// markCompilerRoots keeps alive the constants of every function still being
+// compiled, since those functions are not allocated on the heap until
+// endCompile.
+func (c *Compiler) markCompilerRoots(hp *chunk.Heap) {
+	for fc := c.cpl; fc != nil; fc = fc.enclosing {
+		hp.MarkConstants(fc.function)
+	}
 }
 
-func currentChunk() *chunk.Chunk {
-	return &cpl.function.Ck
+func (c *Compiler) emitReturn() {
+	if c.cpl.functionType == chunk.INITIALIZER {
+		c.emitBytes(chunk.OP_GET_LOCAL, 0)
+	} else {
+		c.emitBytes(chunk.OP_NIL)
+	}
+	c.emitBytes(chunk.OP_RETURN)
 }
 
-func emitConstant(value chunk.Value) uint8 {
-	idx := makeConstant(value)
-	emitBytes(chunk.OP_CONSTANT, idx)
-	return idx
+func (c *Compiler) currentChunk() *chunk.Chunk {
+	return &c.cpl.function.Ck
 }
 
-func makeConstant(value chunk.Value) uint8 {
-	idx := currentChunk().AddConstant(value)
-	if idx >= math.MaxUint8 {
-		fmt.Println("The number of Constants exceeds the limit 255 of one chunk.")
-		os.Exit(1)
+// emitConstantOp emits op with a one-byte constant index, or longOp with a
+// three-byte one if idx does not fit, followed by any further operands.
+func (c *Compiler) emitConstantOp(tk *token, op, longOp byte, idx int, operands ...byte) {
+	if idx <= math.MaxUint8 {
+		c.emitBytesAt(tk, op, byte(idx))
+	} else {
+		c.emitBytesAt(tk, longOp, byte(idx>>16), byte(idx>>8), byte(idx))
 	}
-	idx8 := uint8(idx)
-	return idx8
+	c.emitBytesAt(tk, operands...)
 }
 
-func emitBytes(bts ...byte) {
-	c := currentChunk()
+func (c *Compiler) makeConstant(value chunk.Value) int {
+	key, reusable := constantKeyOf(value)
+	if idx, ok := c.cpl.constants[key]; reusable && ok {
+		return idx
+	}
+
+	idx := c.currentChunk().AddConstant(value)
+	if idx > chunk.MAX_CONSTANT_INDEX {
+		c.errorAtPrevious("Too many constants in one chunk.")
+		return 0
+	}
+	if reusable {
+		c.cpl.constants[key] = idx
+	}
+	return idx
+}
+
+func (c *Compiler) emitBytes(bts ...byte) {
+	c.emitBytesAt(c.prs.previous, bts...)
+}
+
+// emitBytesAt attributes the bytes to tk rather than the previous token, so
+// that runtime errors point at an operator instead of its last operand.
+func (c *Compiler) emitBytesAt(tk *token, bts ...byte) {
+	ck := c.currentChunk()
+	pos := chunk.Position{Line: tk.line, Column: tk.column}
 	for _, bt := range bts {
-		c.Write(bt, prs.previous.line)
+		ck.Write(bt, pos)
 	}
 }
 
-func advance() {
-	prs.previous = prs.current
+func (c *Compiler) advance() {
+	c.prs.previous = c.prs.current
 
 	for {
-		prs.current = scn.scanToken()
-		if prs.current.tp != TOKEN_ERROR {
+		c.prs.current = c.scn.scanToken()
+		if c.prs.current.tp != TOKEN_ERROR {
 			break
 		}
-		errorAtCurrent(prs.current.lexeme)
+		c.errorAtCurrent(c.prs.current.lexeme)
 	}
 }
 
-func consume(tp tokenType, msg string) {
-	if prs.current.tp == tp {
-		advance()
+func (c *Compiler) consume(tp tokenType, msg string) {
+	if c.prs.current.tp == tp {
+		c.advance()
 		return
 	}
 
-	errorAtCurrent(msg)
+	c.errorAtCurrent(msg)
 }
 
-func errorAtCurrent(msg string) {
-	errorAt(prs.current, msg)
+func (c *Compiler) errorAtCurrent(msg string) {
+	c.errorAt(c.prs.current, msg)
 }
 
-func errorAtPrevious(msg string) {
-	errorAt(prs.previous, msg)
+func (c *Compiler) errorAtPrevious(msg string) {
+	c.errorAt(c.prs.previous, msg)
 }
 
-func errorAt(tk *token, msg string) {
-	if prs.panicMode {
+func (c *Compiler) errorAt(tk *token, msg string, notes ...Note) {
+	if c.prs.panicMode {
 		return
 	} else {
-		prs.panicMode = true
+		c.prs.panicMode = true
 	}
 
-	utils.PrintfErr("[line %d] Error", tk.line)
+	c.report(tk, SEVERITY_ERROR, msg, notes)
+	c.prs.hadError = true
+}
+
+func (c *Compiler) report(tk *token, severity Severity, msg string, notes []Note) {
+	d := Diagnostic{
+		Severity: severity,
+		Line:     tk.line,
+		Column:   tk.column,
+		Offset:   tk.offset,
+		Length:   tk.length,
+		Function: c.cpl.function.Name,
+		Message:  msg,
+		Notes:    notes,
+	}
 
 	if tk.tp == TOKEN_EOF {
-		utils.PrintfErr(" at end")
+		d.AtEnd = true
 	} else if tk.tp == TOKEN_ERROR {
 		// Nothing.
 	} else {
-		utils.PrintfErr(" at '%s'", tk.lexeme)
+		d.Lexeme = tk.lexeme
 	}
 
-	utils.PrintfErr(": %s\n", msg)
-	prs.hadError = true
+	c.prs.diagnostics = append(c.prs.diagnostics, d)
+	if c.reporter != nil {
+		c.reporter(d)
+	}
 }
 
-func synchronize() {
-	prs.panicMode = false
+func (c *Compiler) synchronize() {
+	c.prs.panicMode = false
 
-	for prs.current.tp != TOKEN_EOF {
-		if prs.previous.tp == TOKEN_SEMICOLON {
+	for c.prs.current.tp != TOKEN_EOF {
+		if c.prs.previous.tp == TOKEN_SEMICOLON {
 			return
 		}
-		switch prs.current.tp {
+		switch c.prs.current.tp {
 		case TOKEN_CLASS:
 			return
 		case TOKEN_FUN:
@@ -495,10 +819,14 @@ func synchronize() {
 			return
 		case TOKEN_RETURN:
 			return
+		case TOKEN_BREAK:
+			return
+		case TOKEN_CONTINUE:
+			return
 		default:
 		}
 
-		advance()
+		c.advance()
 	}
 
 }
@@ -0,0 +1,178 @@
+package compiler
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/Roderland/glox-vm/chunk"
+)
+
+// TestCompileParallel compiles the same script from many goroutines at
+// once. Run it with -race to check that compilations share no state.
+func TestCompileParallel(t *testing.T) {
+	source := []byte(`
+class Counter {
+  init() { this.n = 0; }
+  next() { this.n = this.n + 1; return this.n; }
+}
+
+fun fib() {
+  var a = 0;
+  var b = 1;
+  fun calc() {
+    var c = b;
+    b = a + b;
+    a = c;
+    return a;
+  }
+  return calc;
+}
+
+var f = fib();
+for (var i = 0; i < 10; i = i + 1) print f();
+`)
+
+	want, errs := Compile(source, chunk.NewHeap(), false)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				got, errs := New(chunk.NewHeap(), false).Compile(source)
+				if errs != nil {
+					t.Error(errs)
+					return
+				}
+				if !bytes.Equal(got.Ck.Codes, want.Ck.Codes) {
+					t.Error("parallel compilation produced different bytecode")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCompileReuse(t *testing.T) {
+	c := New(chunk.NewHeap(), false)
+	if _, errs := c.Compile([]byte("print 1 +;")); len(errs) != 1 {
+		t.Fatalf("expected one error, got %v", errs)
+	}
+	if _, errs := c.Compile([]byte("print 1 + 2;")); errs != nil {
+		t.Fatalf("errors leaked into the next compilation: %v", errs)
+	}
+}
+
+func TestCompileDiagnostics(t *testing.T) {
+	c := New(chunk.NewHeap(), false)
+	var reported []Diagnostic
+	c.SetReporter(func(d Diagnostic) {
+		reported = append(reported, d)
+	})
+
+	fn, diagnostics := c.Compile([]byte("var a = 1;\nprint a +;\nvar = 2;"))
+	if fn != nil {
+		t.Fatal("expected compilation to fail")
+	}
+	if len(diagnostics) != 2 || len(reported) != 2 {
+		t.Fatalf("expected two diagnostics, got %v and reported %v", diagnostics, reported)
+	}
+
+	d := diagnostics[0]
+	if d.Severity != SEVERITY_ERROR || d.Line != 2 || d.Column != 10 || d.Offset != 20 || d.Lexeme != ";" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+	if d = diagnostics[1]; d.Line != 3 || d.Column != 5 || d.Lexeme != "=" {
+		t.Errorf("unexpected diagnostic: %+v", d)
+	}
+
+	// The end of input is reported just past the last token, not on the
+	// blank lines after it.
+	_, diagnostics = New(chunk.NewHeap(), false).Compile([]byte("var a = 1;\nprint a // no semicolon\n\n"))
+	if len(diagnostics) != 1 || !diagnostics[0].AtEnd || diagnostics[0].Line != 2 || diagnostics[0].Column != 8 {
+		t.Errorf("unexpected end of input diagnostic: %+v", diagnostics)
+	}
+}
+
+func TestCompiledCodeVerifies(t *testing.T) {
+	source := []byte(`
+class Base {
+  init(n) { this.n = n; if (n < 0) return; this.n = n * 2; }
+  get() { return this.n; }
+}
+class Derived < Base {
+  init(n) { super.init(n); }
+  get() { var g = super.get; return g() + super.get(); }
+}
+fun make() {
+  var total = 0;
+  for (var i = 0; i < 3; i = i + 1) {
+    var j = i;
+    fun add() { total = total + j; return total; }
+    add();
+  }
+  while (total > 0 and !(total == 1 or nil)) total = total - 1;
+  { var a = 1; { var b = a; fun f() { return a + b; } print f(); } }
+  return total;
+}
+var d = Derived(2);
+d.n = -d.get();
+print make() >= 0 and d.n != 1 or "x" <= "y";
+`)
+	function, errs := Compile(source, chunk.NewHeap(), false)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if err := chunk.Verify(function); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []struct {
+		source    string
+		codes     []byte
+		constants int
+	}{
+		{`print 60 * 60 * 24;`, []byte{chunk.OP_CONSTANT, 0, chunk.OP_PRINT}, 1},
+		{`print "a" + "b" == "ab";`, []byte{chunk.OP_TRUE, chunk.OP_PRINT}, 0},
+		{`print !nil and -(2 - 3) >= 1;`, nil, 0},
+		{`print "a" - 1;`, []byte{chunk.OP_CONSTANT, 0, chunk.OP_CONSTANT, 1, chunk.OP_SUBTRACT, chunk.OP_PRINT}, 2},
+		{`print 1 / 0;`, []byte{chunk.OP_CONSTANT, 0, chunk.OP_CONSTANT, 1, chunk.OP_DIVIDE, chunk.OP_PRINT}, 2},
+		{`var a = 1; print a + 1 + 1;`, nil, 2},
+	}
+	for _, test := range tests {
+		function, errs := Compile([]byte(test.source), chunk.NewHeap(), false)
+		if errs != nil {
+			t.Fatalf("%q: %v", test.source, errs)
+		}
+		ck := &function.Ck
+		// Drop the implicit return.
+		codes := ck.Codes[:len(ck.Codes)-2]
+		if test.codes != nil && !bytes.Equal(codes, test.codes) {
+			t.Errorf("%q compiled to %v, want %v", test.source, codes, test.codes)
+		}
+		if len(ck.Constants) != test.constants {
+			t.Errorf("%q has constants %v, want %d", test.source, ck.Constants, test.constants)
+		}
+	}
+}
+
+func TestREPLPrintsTopLevelExpressions(t *testing.T) {
+	c := New(chunk.NewHeap(), false)
+	c.SetREPL(true)
+	// Only the final statement is read directly by the top-level loop.
+	function, errs := c.Compile([]byte("var i = 0; while (i < 3) i = i + 1; if (true) i; { i; } i"))
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if prints := bytes.Count(function.Ck.Codes, []byte{chunk.OP_PRINT}); prints != 1 {
+		t.Errorf("got %d prints, want 1", prints)
+	}
+}
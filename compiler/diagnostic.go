@@ -0,0 +1,92 @@
+package compiler
+
+import (
+	"fmt"
+	"github.com/Roderland/glox-vm/utils"
+	"strings"
+)
+
+type Severity uint8
+
+const (
+	SEVERITY_ERROR Severity = iota
+	SEVERITY_WARNING
+)
+
+// Diagnostic describes a problem found while compiling.
+type Diagnostic struct {
+	Severity Severity
+	Line     int
+	// Column is 1-based; Offset and Length give the byte span in the source
+	// of the token the diagnostic points at.
+	Column int
+	Offset int
+	Length int
+	// Function is the name of the function being compiled, empty for
+	// top-level code.
+	Function string
+	// Lexeme is the offending token, empty when the scanner itself failed.
+	Lexeme  string
+	AtEnd   bool
+	Message string
+	// Notes point at other code that explains the diagnostic.
+	Notes []Note
+}
+
+// Note attaches a message to a related location, such as where a variable
+// was declared.
+type Note struct {
+	Line    int
+	Column  int
+	Length  int
+	Message string
+}
+
+// Reporter is called with each diagnostic as soon as it is found.
+type Reporter func(d Diagnostic)
+
+func (s Severity) String() string {
+	switch s {
+	case SEVERITY_WARNING:
+		return "Warning"
+	default:
+		return "Error"
+	}
+}
+
+func (d Diagnostic) Error() string {
+	where := ""
+	if d.AtEnd {
+		where = " at end"
+	} else if d.Lexeme != "" {
+		where = fmt.Sprintf(" at '%s'", d.Lexeme)
+	}
+	return fmt.Sprintf("[line %d] %s%s: %s", d.Line, d.Severity, where, d.Message)
+}
+
+// Render formats the diagnostic with the offending line of source and an
+// underline at the token, followed by any notes. file names the source in
+// the output and may be empty.
+func (d Diagnostic) Render(file string, source []byte, color bool) string {
+	primary := utils.Label{Line: d.Line, Column: d.Column, Length: d.Length}
+	var notes []utils.Label
+	for _, note := range d.Notes {
+		notes = append(notes, utils.Label{Line: note.Line, Column: note.Column, Length: note.Length, Message: note.Message})
+	}
+	return utils.Snippet(file, source, strings.ToLower(d.Severity.String()), d.Message, primary, notes, color)
+}
+
+// HasErrors reports whether any of diagnostics is an error rather than a
+// warning.
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+func noteAt(tk *token, msg string) Note {
+	return Note{Line: tk.line, Column: tk.column, Length: tk.length, Message: msg}
+}
@@ -0,0 +1,181 @@
+package compiler
+
+import (
+	"math"
+
+	"github.com/Roderland/glox-vm/chunk"
+)
+
+// literalCode is the code that pushes a literal: the bytes from start to end,
+// which added the constants from constants on.
+type literalCode struct {
+	valid      bool
+	start, end int
+	constants  int
+	value      chunk.Value
+}
+
+// constantKey identifies a deduplicated constant. Strings are interned, so
+// their object is enough.
+type constantKey struct {
+	number uint64
+	str    *chunk.Object
+}
+
+func constantKeyOf(value chunk.Value) (constantKey, bool) {
+	switch {
+	case value.IsNumber():
+		return constantKey{number: math.Float64bits(value.AsNumber())}, true
+	case value.IsString():
+		return constantKey{str: &value.AsString().Object}, true
+	}
+	return constantKey{}, false
+}
+
+// emitLiteral emits the code pushing value and remembers it, so an operator
+// applied to it can be folded.
+func (c *Compiler) emitLiteral(tk *token, value chunk.Value) {
+	lit := literalCode{
+		valid:     true,
+		start:     len(c.currentChunk().Codes),
+		constants: len(c.currentChunk().Constants),
+		value:     value,
+	}
+	switch {
+	case value.IsNil():
+		c.emitBytesAt(tk, chunk.OP_NIL)
+	case value.IsBool() && value.AsBool():
+		c.emitBytesAt(tk, chunk.OP_TRUE)
+	case value.IsBool():
+		c.emitBytesAt(tk, chunk.OP_FALSE)
+	default:
+		c.emitConstantOp(tk, chunk.OP_CONSTANT, chunk.OP_CONSTANT_LONG, c.makeConstant(value))
+	}
+	lit.end = len(c.currentChunk().Codes)
+	c.cpl.literal = lit
+}
+
+// literalEndingAt returns the last literal if it is the final code of the
+// chunk and starts at or after from, with no jump landing inside it.
+func (c *Compiler) literalEndingAt(from int) (literalCode, bool) {
+	lit := c.cpl.literal
+	if !lit.valid || lit.end != len(c.currentChunk().Codes) || lit.start < from || c.cpl.jumpTarget > lit.start {
+		return literalCode{}, false
+	}
+	return lit, true
+}
+
+// replaceLiterals drops the code from first on, which must have pushed only
+// literals, and emits value in its place.
+func (c *Compiler) replaceLiterals(first literalCode, tk *token, value chunk.Value) {
+	ck := c.currentChunk()
+	ck.Truncate(first.start)
+	for _, constant := range ck.Constants[first.constants:] {
+		if key, ok := constantKeyOf(constant); ok {
+			delete(c.cpl.constants, key)
+		}
+	}
+	ck.Constants = ck.Constants[:first.constants]
+	c.emitLiteral(tk, value)
+}
+
+// foldBinary evaluates an operator over two literals the way the VM would.
+// It gives up on anything the VM would report as an error and on results
+// that are not finite, leaving those to run time.
+func (c *Compiler) foldBinary(operator tokenType, a, b chunk.Value) (chunk.Value, bool) {
+	switch operator {
+	case TOKEN_EQUAL_EQUAL:
+		return chunk.NewBool(chunk.Equal(a, b)), true
+	case TOKEN_BANG_EQUAL:
+		return chunk.NewBool(!chunk.Equal(a, b)), true
+	case TOKEN_PLUS:
+		if a.IsString() && b.IsString() {
+			return chunk.NewObject(&c.hp.InternString(a.AsString().Chars + b.AsString().Chars).Object), true
+		}
+	case TOKEN_AMPERSAND, TOKEN_PIPE, TOKEN_CARET, TOKEN_LESS_LESS, TOKEN_GREATER_GREATER:
+		return foldBitwise(operator, a, b)
+	}
+
+	if !a.IsNumber() || !b.IsNumber() {
+		return chunk.Nil, false
+	}
+	x, y := a.AsNumber(), b.AsNumber()
+	switch operator {
+	case TOKEN_GREATER:
+		return chunk.NewBool(x > y), true
+	case TOKEN_GREATER_EQUAL:
+		return chunk.NewBool(!(x < y)), true
+	case TOKEN_LESS:
+		return chunk.NewBool(x < y), true
+	case TOKEN_LESS_EQUAL:
+		return chunk.NewBool(!(x > y)), true
+	}
+
+	var result float64
+	switch operator {
+	case TOKEN_PLUS:
+		result = x + y
+	case TOKEN_MINUS:
+		result = x - y
+	case TOKEN_STAR:
+		result = x * y
+	case TOKEN_SLASH:
+		result = x / y
+	case TOKEN_PERCENT:
+		result = chunk.Modulo(x, y)
+	case TOKEN_TILDE_SLASH:
+		result = chunk.FloorDivide(x, y)
+	case TOKEN_STAR_STAR:
+		result = math.Pow(x, y)
+	default:
+		return chunk.Nil, false
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return chunk.Nil, false
+	}
+	return chunk.NewNumber(result), true
+}
+
+func foldUnary(operator tokenType, a chunk.Value) (chunk.Value, bool) {
+	switch operator {
+	case TOKEN_BANG:
+		return chunk.NewBool(a.IsFalse()), true
+	case TOKEN_MINUS:
+		if a.IsNumber() {
+			return chunk.NewNumber(-a.AsNumber()), true
+		}
+	case TOKEN_TILDE:
+		if x, ok := chunk.ToInteger(a); ok {
+			return chunk.NewNumber(float64(^x)), true
+		}
+	}
+	return chunk.Nil, false
+}
+
+func foldBitwise(operator tokenType, a, b chunk.Value) (chunk.Value, bool) {
+	x, ok := chunk.ToInteger(a)
+	y, ok2 := chunk.ToInteger(b)
+	if !ok || !ok2 {
+		return chunk.Nil, false
+	}
+
+	var result int64
+	switch operator {
+	case TOKEN_AMPERSAND:
+		result = x & y
+	case TOKEN_PIPE:
+		result = x | y
+	case TOKEN_CARET:
+		result = x ^ y
+	case TOKEN_LESS_LESS, TOKEN_GREATER_GREATER:
+		if !chunk.IsShiftCount(y) {
+			return chunk.Nil, false
+		}
+		if operator == TOKEN_LESS_LESS {
+			result = x << uint64(y)
+		} else {
+			result = x >> uint64(y)
+		}
+	}
+	return chunk.NewNumber(float64(result)), true
+}
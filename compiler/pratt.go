@@ -14,147 +14,218 @@ const (
 	PREC_AND                   // and
 	PREC_EQUALITY              // == !=
 	PREC_COMPARISON            // < > <= >=
+	PREC_BIT_OR                // |
+	PREC_BIT_XOR               // ^
+	PREC_BIT_AND               // &
+	PREC_SHIFT                 // << >>
 	PREC_TERM                  // + -
-	PREC_FACTOR                // * /
-	PREC_UNARY                 // ! -
+	PREC_FACTOR                // * / % ~/
+	PREC_UNARY                 // ! - ~
+	PREC_POWER                 // **
 	PREC_CALL                  // . ()
 	PREC_PRIMARY
 )
 
 type parseRule struct {
-	prefix func(bool)
-	infix  func(bool)
+	prefix func(*Compiler, bool)
+	infix  func(*Compiler, bool)
 	pd     Precedence
 }
 
-var rules = [40]parseRule{}
+var rules = [TOKEN_EOF + 1]parseRule{}
 
 func init() {
-	rules[TOKEN_LEFT_PAREN] = parseRule{grouping, call, PREC_CALL}
+	rules[TOKEN_LEFT_PAREN] = parseRule{(*Compiler).grouping, (*Compiler).call, PREC_CALL}
 	rules[TOKEN_RIGHT_PAREN] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_LEFT_BRACE] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_RIGHT_BRACE] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_COMMA] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_DOT] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_MINUS] = parseRule{unary, binary, PREC_TERM}
-	rules[TOKEN_PLUS] = parseRule{nil, binary, PREC_TERM}
+	rules[TOKEN_DOT] = parseRule{nil, (*Compiler).dot, PREC_CALL}
+	rules[TOKEN_MINUS] = parseRule{(*Compiler).unary, (*Compiler).binary, PREC_TERM}
+	rules[TOKEN_PLUS] = parseRule{nil, (*Compiler).binary, PREC_TERM}
 	rules[TOKEN_SEMICOLON] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_SLASH] = parseRule{nil, binary, PREC_FACTOR}
-	rules[TOKEN_STAR] = parseRule{nil, binary, PREC_FACTOR}
-	rules[TOKEN_BANG] = parseRule{unary, nil, PREC_NONE}
-	rules[TOKEN_BANG_EQUAL] = parseRule{nil, binary, PREC_EQUALITY}
+	rules[TOKEN_SLASH] = parseRule{nil, (*Compiler).binary, PREC_FACTOR}
+	rules[TOKEN_STAR] = parseRule{nil, (*Compiler).binary, PREC_FACTOR}
+	rules[TOKEN_PERCENT] = parseRule{nil, (*Compiler).binary, PREC_FACTOR}
+	rules[TOKEN_AMPERSAND] = parseRule{nil, (*Compiler).binary, PREC_BIT_AND}
+	rules[TOKEN_PIPE] = parseRule{nil, (*Compiler).binary, PREC_BIT_OR}
+	rules[TOKEN_CARET] = parseRule{nil, (*Compiler).binary, PREC_BIT_XOR}
+	rules[TOKEN_TILDE] = parseRule{(*Compiler).unary, nil, PREC_NONE}
+	rules[TOKEN_BANG] = parseRule{(*Compiler).unary, nil, PREC_NONE}
+	rules[TOKEN_BANG_EQUAL] = parseRule{nil, (*Compiler).binary, PREC_EQUALITY}
 	rules[TOKEN_EQUAL] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_EQUAL_EQUAL] = parseRule{nil, binary, PREC_EQUALITY}
-	rules[TOKEN_GREATER] = parseRule{nil, binary, PREC_COMPARISON}
-	rules[TOKEN_GREATER_EQUAL] = parseRule{nil, binary, PREC_COMPARISON}
-	rules[TOKEN_LESS] = parseRule{nil, binary, PREC_COMPARISON}
-	rules[TOKEN_LESS_EQUAL] = parseRule{nil, binary, PREC_COMPARISON}
-	rules[TOKEN_IDENTIFIER] = parseRule{variable, nil, PREC_NONE}
-	rules[TOKEN_STRING] = parseRule{str, nil, PREC_NONE}
-	rules[TOKEN_NUMBER] = parseRule{number, nil, PREC_NONE}
-	rules[TOKEN_AND] = parseRule{nil, and, PREC_AND}
+	rules[TOKEN_EQUAL_EQUAL] = parseRule{nil, (*Compiler).binary, PREC_EQUALITY}
+	rules[TOKEN_GREATER] = parseRule{nil, (*Compiler).binary, PREC_COMPARISON}
+	rules[TOKEN_GREATER_EQUAL] = parseRule{nil, (*Compiler).binary, PREC_COMPARISON}
+	rules[TOKEN_LESS] = parseRule{nil, (*Compiler).binary, PREC_COMPARISON}
+	rules[TOKEN_LESS_EQUAL] = parseRule{nil, (*Compiler).binary, PREC_COMPARISON}
+	rules[TOKEN_STAR_STAR] = parseRule{nil, (*Compiler).binary, PREC_POWER}
+	rules[TOKEN_TILDE_SLASH] = parseRule{nil, (*Compiler).binary, PREC_FACTOR}
+	rules[TOKEN_LESS_LESS] = parseRule{nil, (*Compiler).binary, PREC_SHIFT}
+	rules[TOKEN_GREATER_GREATER] = parseRule{nil, (*Compiler).binary, PREC_SHIFT}
+	rules[TOKEN_IDENTIFIER] = parseRule{(*Compiler).variable, nil, PREC_NONE}
+	rules[TOKEN_STRING] = parseRule{(*Compiler).str, nil, PREC_NONE}
+	rules[TOKEN_NUMBER] = parseRule{(*Compiler).number, nil, PREC_NONE}
+	rules[TOKEN_AND] = parseRule{nil, (*Compiler).and, PREC_AND}
+	rules[TOKEN_BREAK] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_CLASS] = parseRule{nil, nil, PREC_NONE}
+	rules[TOKEN_CONTINUE] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_ELSE] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_FALSE] = parseRule{literal, nil, PREC_NONE}
+	rules[TOKEN_FALSE] = parseRule{(*Compiler).literal, nil, PREC_NONE}
 	rules[TOKEN_FOR] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_FUN] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_IF] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_NIL] = parseRule{literal, nil, PREC_NONE}
-	rules[TOKEN_OR] = parseRule{nil, or, PREC_OR}
+	rules[TOKEN_NIL] = parseRule{(*Compiler).literal, nil, PREC_NONE}
+	rules[TOKEN_OR] = parseRule{nil, (*Compiler).or, PREC_OR}
 	rules[TOKEN_PRINT] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_RETURN] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_SUPER] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_THIS] = parseRule{nil, nil, PREC_NONE}
-	rules[TOKEN_TRUE] = parseRule{literal, nil, PREC_NONE}
+	rules[TOKEN_SUPER] = parseRule{(*Compiler).super, nil, PREC_NONE}
+	rules[TOKEN_THIS] = parseRule{(*Compiler).this, nil, PREC_NONE}
+	rules[TOKEN_TRUE] = parseRule{(*Compiler).literal, nil, PREC_NONE}
 	rules[TOKEN_VAR] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_WHILE] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_ERROR] = parseRule{nil, nil, PREC_NONE}
 	rules[TOKEN_EOF] = parseRule{nil, nil, PREC_NONE}
 }
 
-func or(canAssign bool) {
-	elseJump := emitJump(chunk.OP_JUMP_IF_FALSE)
-	endJump := emitJump(chunk.OP_JUMP)
+func (c *Compiler) or(canAssign bool) {
+	elseJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	endJump := c.emitJump(chunk.OP_JUMP)
 
-	patchJump(elseJump)
-	emitBytes(chunk.OP_POP)
+	c.patchJump(elseJump)
+	c.emitBytes(chunk.OP_POP)
 
-	parsePrecedence(PREC_OR)
-	patchJump(endJump)
+	c.parsePrecedence(PREC_OR)
+	c.patchJump(endJump)
 }
 
-func and(canAssign bool) {
-	endJump := emitJump(chunk.OP_JUMP_IF_FALSE)
-	emitBytes(chunk.OP_POP)
-	parsePrecedence(PREC_AND)
-	patchJump(endJump)
+func (c *Compiler) and(canAssign bool) {
+	endJump := c.emitJump(chunk.OP_JUMP_IF_FALSE)
+	c.emitBytes(chunk.OP_POP)
+	c.parsePrecedence(PREC_AND)
+	c.patchJump(endJump)
 }
 
-func call(canAssign bool) {
-	argCount := argumentList()
-	emitBytes(chunk.OP_CALL, argCount)
+func (c *Compiler) call(canAssign bool) {
+	paren := c.prs.previous
+	argCount := c.argumentList()
+	c.emitBytesAt(paren, chunk.OP_CALL, argCount)
 }
 
-func argumentList() uint8 {
+func (c *Compiler) dot(canAssign bool) {
+	c.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	property := c.prs.previous
+	name := c.identifierConstant(property)
+
+	if canAssign && c.match(TOKEN_EQUAL) {
+		c.expression()
+		c.emitConstantOp(property, chunk.OP_SET_PROPERTY, chunk.OP_SET_PROPERTY_LONG, name)
+	} else if c.match(TOKEN_LEFT_PAREN) {
+		argCount := c.argumentList()
+		c.emitConstantOp(property, chunk.OP_INVOKE, chunk.OP_INVOKE_LONG, name, argCount)
+	} else {
+		c.emitConstantOp(property, chunk.OP_GET_PROPERTY, chunk.OP_GET_PROPERTY_LONG, name)
+	}
+}
+
+func (c *Compiler) argumentList() uint8 {
 	argCount := 0
-	if !check(TOKEN_RIGHT_PAREN) {
-		expression()
+	if !c.check(TOKEN_RIGHT_PAREN) {
+		c.expression()
 		argCount++
-		for match(TOKEN_COMMA) {
-			expression()
+		for c.match(TOKEN_COMMA) {
+			c.expression()
 			if argCount == 255 {
-				errorAtPrevious("Can't have more than 255 arguments.")
+				c.errorAtPrevious("Can't have more than 255 arguments.")
 			}
 			argCount++
 		}
 	}
-	consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+	c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
 	return uint8(argCount)
 }
 
-func literal(canAssign bool) {
-	tp := prs.previous.tp
+func (c *Compiler) literal(canAssign bool) {
+	tp := c.prs.previous.tp
 	switch tp {
 	case TOKEN_NIL:
-		emitBytes(chunk.OP_NIL)
+		c.emitLiteral(c.prs.previous, chunk.Nil)
 	case TOKEN_FALSE:
-		emitBytes(chunk.OP_FALSE)
+		c.emitLiteral(c.prs.previous, chunk.False)
 	case TOKEN_TRUE:
-		emitBytes(chunk.OP_TRUE)
+		c.emitLiteral(c.prs.previous, chunk.True)
 	default:
 		return
 	}
 }
 
-func variable(canAssign bool) {
-	namedVariable(prs.previous, canAssign)
+func (c *Compiler) variable(canAssign bool) {
+	c.namedVariable(c.prs.previous, canAssign)
+}
+
+func (c *Compiler) this(canAssign bool) {
+	if c.currentClass == nil {
+		c.errorAtPrevious("Can't use 'this' outside of a class.")
+		return
+	}
+	c.variable(false)
+}
+
+func (c *Compiler) super(canAssign bool) {
+	if c.currentClass == nil {
+		c.errorAtPrevious("Can't use 'super' outside of a class.")
+	} else if !c.currentClass.hasSuperclass {
+		c.errorAtPrevious("Can't use 'super' in a class with no superclass.")
+	}
+
+	c.consume(TOKEN_DOT, "Expect '.' after 'super'.")
+	c.consume(TOKEN_IDENTIFIER, "Expect superclass method name.")
+	name := c.identifierConstant(c.prs.previous)
+
+	thisToken := c.syntheticToken("this")
+	superToken := c.syntheticToken("super")
+	c.namedVariable(&thisToken, false)
+	if c.match(TOKEN_LEFT_PAREN) {
+		argCount := c.argumentList()
+		c.namedVariable(&superToken, false)
+		c.emitConstantOp(c.prs.previous, chunk.OP_SUPER_INVOKE, chunk.OP_SUPER_INVOKE_LONG, name, argCount)
+	} else {
+		c.namedVariable(&superToken, false)
+		c.emitConstantOp(c.prs.previous, chunk.OP_GET_SUPER, chunk.OP_GET_SUPER_LONG, name)
+	}
 }
 
-func namedVariable(varName *token, canAssign bool) {
-	var getOp, setOp byte
-	arg := isLocal(cpl, varName)
+func (c *Compiler) namedVariable(varName *token, canAssign bool) {
+	// Locals and upvalues always fit in a byte, so only the global
+	// instructions need long forms.
+	var getOp, setOp, getLongOp, setLongOp byte
+	arg := c.isLocal(c.cpl, varName)
 	if arg != -1 {
-		getOp = chunk.OP_GET_LOCAL
-		setOp = chunk.OP_SET_LOCAL
+		getOp, getLongOp = chunk.OP_GET_LOCAL, chunk.OP_GET_LOCAL
+		setOp, setLongOp = chunk.OP_SET_LOCAL, chunk.OP_SET_LOCAL
+	} else if arg = c.isUpvalue(c.cpl, varName); arg != -1 {
+		getOp, getLongOp = chunk.OP_GET_UPVALUE, chunk.OP_GET_UPVALUE
+		setOp, setLongOp = chunk.OP_SET_UPVALUE, chunk.OP_SET_UPVALUE
 	} else {
-		arg = int(identifierConstant(varName))
-		getOp = chunk.OP_GET_GLOBAL
-		setOp = chunk.OP_SET_GLOBAL
+		arg = c.identifierConstant(varName)
+		getOp, getLongOp = chunk.OP_GET_GLOBAL, chunk.OP_GET_GLOBAL_LONG
+		setOp, setLongOp = chunk.OP_SET_GLOBAL, chunk.OP_SET_GLOBAL_LONG
 	}
 
-	if canAssign && match(TOKEN_EQUAL) {
-		expression()
-		emitBytes(setOp, uint8(arg))
+	if canAssign && c.match(TOKEN_EQUAL) {
+		c.expression()
+		c.emitConstantOp(varName, setOp, setLongOp, arg)
 	} else {
-		emitBytes(getOp, uint8(arg))
+		c.emitConstantOp(varName, getOp, getLongOp, arg)
 	}
 }
 
-func isLocal(cpl *compiler, name *token) int {
+func (c *Compiler) isLocal(cpl *compiler, name *token) int {
 	for i := cpl.localCount - 1; i >= 0; i-- {
 		if cpl.locals[i].name.lexeme == name.lexeme {
 			if cpl.locals[i].depth == -1 {
-				errorAtPrevious("Can't read local variable in its own initializer.")
+				c.errorAt(c.prs.previous, "Can't read local variable in its own initializer.",
+					noteAt(&cpl.locals[i].name, "variable declared here"))
 			}
 			return i
 		}
@@ -162,56 +233,108 @@ func isLocal(cpl *compiler, name *token) int {
 	return -1
 }
 
-func expression() {
-	parsePrecedence(PREC_ASSIGNMENT)
+func (c *Compiler) isUpvalue(cpl *compiler, name *token) int {
+	if cpl.enclosing == nil {
+		return -1
+	}
+
+	lc := c.isLocal(cpl.enclosing, name)
+	if lc != -1 {
+		cpl.enclosing.locals[lc].isCaptured = true
+		return c.addUpvalue(cpl, uint8(lc), true)
+	}
+
+	uv := c.isUpvalue(cpl.enclosing, name)
+	if uv != -1 {
+		return c.addUpvalue(cpl, uint8(uv), false)
+	}
+
+	return -1
+}
+
+func (c *Compiler) addUpvalue(cpl *compiler, index uint8, isLocal bool) int {
+	upvalueCount := cpl.function.UpvalueCount
+
+	for i := 0; i < upvalueCount; i++ {
+		uv := &cpl.upvalues[i]
+		if uv.index == index && uv.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if upvalueCount == MAX_LOCAL_COUNT {
+		c.errorAtPrevious("Too many closure variables in function.")
+		return 0
+	}
+
+	cpl.upvalues[upvalueCount].isLocal = isLocal
+	cpl.upvalues[upvalueCount].index = index
+	cpl.function.UpvalueCount++
+	return upvalueCount
 }
 
-func parsePrecedence(pd Precedence) {
-	advance()
-	prefixFn := getParseRule(prs.previous.tp).prefix
+func (c *Compiler) expression() {
+	c.parsePrecedence(PREC_ASSIGNMENT)
+}
+
+func (c *Compiler) parsePrecedence(pd Precedence) {
+	c.advance()
+	prefixFn := getParseRule(c.prs.previous.tp).prefix
 	if prefixFn == nil {
-		errorAtPrevious("Expect expression.")
+		c.errorAtPrevious("Expect expression.")
 		return
 	}
 
 	canAssign := pd <= PREC_ASSIGNMENT
-	prefixFn(canAssign)
+	prefixFn(c, canAssign)
 
-	for pd <= getParseRule(prs.current.tp).pd {
-		advance()
-		infixFn := getParseRule(prs.previous.tp).infix
-		infixFn(canAssign)
+	for pd <= getParseRule(c.prs.current.tp).pd {
+		c.advance()
+		infixFn := getParseRule(c.prs.previous.tp).infix
+		infixFn(c, canAssign)
 	}
 
-	if canAssign && match(TOKEN_EQUAL) {
-		errorAtPrevious("Invalid assignment target.")
+	if canAssign && c.match(TOKEN_EQUAL) {
+		c.errorAtPrevious("Invalid assignment target.")
 	}
 }
 
-func number(canAssign bool) {
-	float, _ := strconv.ParseFloat(prs.previous.lexeme, 64)
-	emitConstant(chunk.NewNumber(float))
+func (c *Compiler) number(canAssign bool) {
+	float, _ := strconv.ParseFloat(c.prs.previous.lexeme, 64)
+	c.emitLiteral(c.prs.previous, chunk.NewNumber(float))
 }
 
-func str(canAssign bool) {
-	emitConstant(chunk.NewString(prs.previous.lexeme[1 : len(prs.previous.lexeme)-1]))
+func (c *Compiler) str(canAssign bool) {
+	chars := c.prs.previous.lexeme[1 : len(c.prs.previous.lexeme)-1]
+	c.emitLiteral(c.prs.previous, chunk.NewObject(&c.hp.InternString(chars).Object))
 }
 
-func grouping(canAssign bool) {
-	expression()
-	consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+func (c *Compiler) grouping(canAssign bool) {
+	c.expression()
+	c.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
-func unary(canAssign bool) {
-	operatorType := prs.previous.tp
+func (c *Compiler) unary(canAssign bool) {
+	operator := c.prs.previous
+	operatorType := operator.tp
+	start := len(c.currentChunk().Codes)
+
+	c.parsePrecedence(PREC_UNARY)
 
-	parsePrecedence(PREC_UNARY)
+	if operand, ok := c.literalEndingAt(start); ok && operand.start == start {
+		if value, ok := foldUnary(operatorType, operand.value); ok {
+			c.replaceLiterals(operand, operator, value)
+			return
+		}
+	}
 
 	switch operatorType {
 	case TOKEN_MINUS:
-		emitBytes(chunk.OP_NEGATE)
+		c.emitBytesAt(operator, chunk.OP_NEGATE)
 	case TOKEN_BANG:
-		emitBytes(chunk.OP_NOT)
+		c.emitBytesAt(operator, chunk.OP_NOT)
+	case TOKEN_TILDE:
+		c.emitBytesAt(operator, chunk.OP_BIT_NOT)
 	default:
 		return
 	}
@@ -221,32 +344,62 @@ func getParseRule(tp tokenType) *parseRule {
 	return &rules[tp]
 }
 
-func binary(canAssign bool) {
-	operatorType := prs.previous.tp
+func (c *Compiler) binary(canAssign bool) {
+	operator := c.prs.previous
+	operatorType := operator.tp
+	left, foldable := c.literalEndingAt(0)
 
-	parsePrecedence(getParseRule(operatorType).pd + 1)
+	// ** is right-associative, so its right operand may contain another.
+	pd := getParseRule(operatorType).pd
+	if operatorType != TOKEN_STAR_STAR {
+		pd++
+	}
+	c.parsePrecedence(pd)
+
+	if right, ok := c.literalEndingAt(left.end); foldable && ok && right.start == left.end {
+		if value, ok := c.foldBinary(operatorType, left.value, right.value); ok {
+			c.replaceLiterals(left, operator, value)
+			return
+		}
+	}
 
 	switch operatorType {
 	case TOKEN_PLUS:
-		emitBytes(chunk.OP_ADD)
+		c.emitBytesAt(operator, chunk.OP_ADD)
 	case TOKEN_MINUS:
-		emitBytes(chunk.OP_SUBTRACT)
+		c.emitBytesAt(operator, chunk.OP_SUBTRACT)
 	case TOKEN_STAR:
-		emitBytes(chunk.OP_MULTIPLY)
+		c.emitBytesAt(operator, chunk.OP_MULTIPLY)
 	case TOKEN_SLASH:
-		emitBytes(chunk.OP_DIVIDE)
+		c.emitBytesAt(operator, chunk.OP_DIVIDE)
+	case TOKEN_PERCENT:
+		c.emitBytesAt(operator, chunk.OP_MODULO)
+	case TOKEN_TILDE_SLASH:
+		c.emitBytesAt(operator, chunk.OP_FLOOR_DIVIDE)
+	case TOKEN_STAR_STAR:
+		c.emitBytesAt(operator, chunk.OP_POWER)
+	case TOKEN_AMPERSAND:
+		c.emitBytesAt(operator, chunk.OP_BIT_AND)
+	case TOKEN_PIPE:
+		c.emitBytesAt(operator, chunk.OP_BIT_OR)
+	case TOKEN_CARET:
+		c.emitBytesAt(operator, chunk.OP_BIT_XOR)
+	case TOKEN_LESS_LESS:
+		c.emitBytesAt(operator, chunk.OP_SHIFT_LEFT)
+	case TOKEN_GREATER_GREATER:
+		c.emitBytesAt(operator, chunk.OP_SHIFT_RIGHT)
 	case TOKEN_BANG_EQUAL:
-		emitBytes(chunk.OP_EQUAL, chunk.OP_NOT)
+		c.emitBytesAt(operator, chunk.OP_EQUAL, chunk.OP_NOT)
 	case TOKEN_EQUAL_EQUAL:
-		emitBytes(chunk.OP_EQUAL)
+		c.emitBytesAt(operator, chunk.OP_EQUAL)
 	case TOKEN_GREATER:
-		emitBytes(chunk.OP_GREATER)
+		c.emitBytesAt(operator, chunk.OP_GREATER)
 	case TOKEN_GREATER_EQUAL:
-		emitBytes(chunk.OP_LESS, chunk.OP_NOT)
+		c.emitBytesAt(operator, chunk.OP_LESS, chunk.OP_NOT)
 	case TOKEN_LESS:
-		emitBytes(chunk.OP_LESS)
+		c.emitBytesAt(operator, chunk.OP_LESS)
 	case TOKEN_LESS_EQUAL:
-		emitBytes(chunk.OP_GREATER, chunk.OP_NOT)
+		c.emitBytesAt(operator, chunk.OP_GREATER, chunk.OP_NOT)
 	default:
 		return
 	}
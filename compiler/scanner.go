@@ -1,24 +1,70 @@
 package compiler
 
 type scanner struct {
-	source  []byte
-	start   int
-	current int
-	line    int
+	source      []byte
+	start       int
+	current     int
+	line        int
+	lineStart   int
+	startLine   int
+	startColumn int
+	// endLine, endColumn and endOffset are just past the last token, which
+	// is where the end of input is reported rather than after any trailing
+	// blank lines or comments.
+	endLine   int
+	endColumn int
+	endOffset int
+}
+
+// IsIncomplete reports whether source stops inside a block, a parenthesized
+// expression or a string, in which case a REPL should read more lines before
+// compiling it.
+func IsIncomplete(source []byte) bool {
+	var scn scanner
+	scn.init(source)
+
+	depth := 0
+	for {
+		tk := scn.scanToken()
+		switch tk.tp {
+		case TOKEN_LEFT_BRACE, TOKEN_LEFT_PAREN:
+			depth++
+		case TOKEN_RIGHT_BRACE, TOKEN_RIGHT_PAREN:
+			depth--
+		case TOKEN_ERROR:
+			if tk.lexeme == "Unterminated string." {
+				return true
+			}
+		case TOKEN_EOF:
+			return depth > 0
+		}
+	}
 }
 
 func (scn *scanner) init(source []byte) {
-	scn.source = append(source, ' ')
+	// Copy rather than append, which could write into spare capacity of the
+	// caller's slice while another scanner reads it.
+	scn.source = make([]byte, len(source)+1)
+	copy(scn.source, source)
+	scn.source[len(source)] = ' '
+	scn.start = 0
+	scn.current = 0
 	scn.line = 1
+	scn.lineStart = 0
+	scn.endLine = 1
+	scn.endColumn = 1
+	scn.endOffset = 0
 }
 
 func (scn *scanner) scanToken() *token {
 	scn.skipWhite()
 
 	scn.start = scn.current
+	scn.startLine = scn.line
+	scn.startColumn = scn.start - scn.lineStart + 1
 
 	if scn.isAtEnd() {
-		return scn.makeToken(TOKEN_EOF)
+		return &token{tp: TOKEN_EOF, line: scn.endLine, column: scn.endColumn, offset: scn.endOffset}
 	}
 
 	c := scn.advance()
@@ -51,9 +97,27 @@ func (scn *scanner) scanToken() *token {
 	case '+':
 		return scn.makeToken(TOKEN_PLUS)
 	case '*':
-		return scn.makeToken(TOKEN_STAR)
+		if scn.match('*') {
+			return scn.makeToken(TOKEN_STAR_STAR)
+		} else {
+			return scn.makeToken(TOKEN_STAR)
+		}
 	case '/':
 		return scn.makeToken(TOKEN_SLASH)
+	case '%':
+		return scn.makeToken(TOKEN_PERCENT)
+	case '~':
+		if scn.match('/') {
+			return scn.makeToken(TOKEN_TILDE_SLASH)
+		} else {
+			return scn.makeToken(TOKEN_TILDE)
+		}
+	case '&':
+		return scn.makeToken(TOKEN_AMPERSAND)
+	case '|':
+		return scn.makeToken(TOKEN_PIPE)
+	case '^':
+		return scn.makeToken(TOKEN_CARET)
 	case '!':
 		if scn.match('=') {
 			return scn.makeToken(TOKEN_BANG_EQUAL)
@@ -69,12 +133,16 @@ func (scn *scanner) scanToken() *token {
 	case '<':
 		if scn.match('=') {
 			return scn.makeToken(TOKEN_LESS_EQUAL)
+		} else if scn.match('<') {
+			return scn.makeToken(TOKEN_LESS_LESS)
 		} else {
 			return scn.makeToken(TOKEN_LESS)
 		}
 	case '>':
 		if scn.match('=') {
 			return scn.makeToken(TOKEN_GREATER_EQUAL)
+		} else if scn.match('>') {
+			return scn.makeToken(TOKEN_GREATER_GREATER)
 		} else {
 			return scn.makeToken(TOKEN_GREATER)
 		}
@@ -98,6 +166,7 @@ func (scn *scanner) skipWhite() {
 		case '\n':
 			scn.line++
 			scn.advance()
+			scn.lineStart = scn.current
 		case '/':
 			if scn.peekNext() == '/' {
 				// A comment goes until the end of the line.
@@ -117,6 +186,7 @@ func (scn *scanner) string() *token {
 	for !scn.isAtEnd() && scn.peek() != '"' {
 		if scn.peek() == '\n' {
 			scn.line++
+			scn.lineStart = scn.current + 1
 		}
 		scn.advance()
 	}
@@ -175,19 +245,33 @@ func (scn *scanner) isAtEnd() bool {
 func (scn *scanner) makeToken(tp tokenType) *token {
 	var tk token
 	tk.tp = tp
-	tk.line = scn.line
+	tk.line = scn.startLine
+	tk.column = scn.startColumn
+	tk.offset = scn.start
+	tk.length = scn.current - scn.start
 	tk.lexeme = string(scn.source[scn.start:scn.current])
+	scn.markEnd()
 	return &tk
 }
 
 func (scn *scanner) errorToken(msg string) *token {
 	var tk token
 	tk.tp = TOKEN_ERROR
-	tk.line = scn.line
+	tk.line = scn.startLine
+	tk.column = scn.startColumn
+	tk.offset = scn.start
+	tk.length = scn.current - scn.start
 	tk.lexeme = msg
+	scn.markEnd()
 	return &tk
 }
 
+func (scn *scanner) markEnd() {
+	scn.endLine = scn.line
+	scn.endColumn = scn.current - scn.lineStart + 1
+	scn.endOffset = scn.current
+}
+
 func (scn *scanner) ident() *token {
 	for isAlpha(scn.peek()) || isDigit(scn.peek()) {
 		scn.advance()
@@ -199,8 +283,17 @@ func (scn *scanner) identifierType() tokenType {
 	switch scn.source[scn.start] {
 	case 'a':
 		return scn.checkKeyword(1, 2, "nd", TOKEN_AND)
+	case 'b':
+		return scn.checkKeyword(1, 4, "reak", TOKEN_BREAK)
 	case 'c':
-		return scn.checkKeyword(1, 4, "lass", TOKEN_CLASS)
+		if scn.current-scn.start > 1 {
+			switch scn.source[scn.start+1] {
+			case 'l':
+				return scn.checkKeyword(2, 3, "ass", TOKEN_CLASS)
+			case 'o':
+				return scn.checkKeyword(2, 6, "ntinue", TOKEN_CONTINUE)
+			}
+		}
 	case 'e':
 		return scn.checkKeyword(1, 3, "lse", TOKEN_ELSE)
 	case 'i':
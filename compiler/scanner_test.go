@@ -29,3 +29,18 @@ func TestScanner(t *testing.T) {
 		}
 	}
 }
+
+func TestIsIncomplete(t *testing.T) {
+	for source, want := range map[string]bool{
+		"print 1;":              false,
+		"fun f() {":             true,
+		"fun f() {\n  print (1": true,
+		"fun f() {}":            false,
+		"print \"abc":           true,
+		"print 1 +":             false,
+	} {
+		if got := IsIncomplete([]byte(source)); got != want {
+			t.Errorf("IsIncomplete(%q) = %v, want %v", source, got, want)
+		}
+	}
+}
@@ -5,6 +5,11 @@ type (
 		tp     tokenType
 		lexeme string
 		line   int
+		// column is 1-based and offset is the byte offset of the token's
+		// first character in the source; length is its size in bytes.
+		column int
+		offset int
+		length int
 	}
 
 	tokenType byte
@@ -23,6 +28,11 @@ const (
 	TOKEN_SEMICOLON
 	TOKEN_SLASH
 	TOKEN_STAR
+	TOKEN_PERCENT
+	TOKEN_AMPERSAND
+	TOKEN_PIPE
+	TOKEN_CARET
+	TOKEN_TILDE
 
 	/* One or two character tokens. */
 	TOKEN_BANG
@@ -33,6 +43,10 @@ const (
 	TOKEN_GREATER_EQUAL
 	TOKEN_LESS
 	TOKEN_LESS_EQUAL
+	TOKEN_STAR_STAR
+	TOKEN_TILDE_SLASH
+	TOKEN_LESS_LESS
+	TOKEN_GREATER_GREATER
 
 	/* Literals. */
 	TOKEN_IDENTIFIER
@@ -41,7 +55,9 @@ const (
 
 	/* Keywords. */
 	TOKEN_AND
+	TOKEN_BREAK
 	TOKEN_CLASS
+	TOKEN_CONTINUE
 	TOKEN_ELSE
 	TOKEN_FALSE
 	TOKEN_FOR
@@ -1,47 +1,282 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/Roderland/glox-vm/chunk"
 	"github.com/Roderland/glox-vm/compiler"
 	"github.com/Roderland/glox-vm/utils"
 	"github.com/Roderland/glox-vm/vm"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
-type InterpretResult uint8
-
+// Exit codes follow sysexits.h.
 const (
-	OK InterpretResult = iota
-	COMPILE_ERROR
-	RUNTIME_ERROR
+	EX_OK        = 0
+	EX_USAGE     = 64
+	EX_DATAERR   = 65
+	EX_SOFTWARE  = 70
+	EX_CANTCREAT = 73
+)
+
+var (
+	stressGC     bool
+	gcGrowFactor int
+	maxFrames    int
+	maxStack     int
+	maxHeap      int
+	color        string
+	numbers      string
+	numberMode   vm.NumberMode
+	disassemble  bool
+	optimize     bool
+	trace        bool
+	output       string
+
+	// stdin, stdout and stderr are the streams of the current run.
+	stdin          io.Reader
+	stdout, stderr io.Writer
 )
 
+type command struct {
+	summary string
+	// flags registers the options specific to the command, if any.
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) int
+}
+
+var commands = map[string]*command{
+	"run":     {"compile and run a script or .loxc file, or start a REPL without one (default)", execFlags, runCommand},
+	"compile": {"compile a script to a .loxc bytecode file", compileFlags, compileCommand},
+	"disasm":  {"print the bytecode of a script without running it", nil, disasmCommand},
+	"trace":   {"run a script, printing the stack and each instruction as it executes", nil, traceCommand},
+	"check":   {"report compile errors in a script without running it", nil, checkCommand},
+}
+
+var commandOrder = []string{"run", "compile", "disasm", "trace", "check"}
+
+func execFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&disassemble, "disasm", false, "print the bytecode of every function before running it")
+	fs.BoolVar(&trace, "trace", false, "print the stack and each instruction as it executes")
+}
+
+func compileFlags(fs *flag.FlagSet) {
+	fs.StringVar(&output, "o", "", "write the bytecode to this file (default the script name with a .loxc extension)")
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		utils.PrintfErr("Usage: glox [script]\n")
-		os.Exit(64)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run carries out the command line args and returns the exit status.
+func run(args []string, in io.Reader, out, errOut io.Writer) int {
+	stdin, stdout, stderr = in, out, errOut
+	utils.SetOutput(out, errOut)
+	// Options that only some commands register keep their defaults for the
+	// others.
+	disassemble, trace, output = false, false, ""
+
+	name := "run"
+	if len(args) > 0 && commands[args[0]] != nil {
+		name, args = args[0], args[1:]
 	}
+	cmd := commands[name]
 
-	bytes, err := ioutil.ReadFile(os.Args[1])
+	fs := flag.NewFlagSet("glox "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&stressGC, "stress-gc", false, "run a garbage collection before every allocation")
+	fs.IntVar(&gcGrowFactor, "gc-grow-factor", chunk.DEFAULT_GROW_FACTOR, "heap growth factor between collections")
+	fs.IntVar(&maxFrames, "max-frames", vm.DEFAULT_MAX_FRAME, "maximum call depth")
+	fs.IntVar(&maxStack, "max-stack", 0, "maximum value stack slots (default max-frames * 256)")
+	fs.IntVar(&maxHeap, "max-heap", 0, "maximum heap size in bytes (default unlimited)")
+	fs.StringVar(&color, "color", "auto", "color output: auto, always or never")
+	fs.BoolVar(&optimize, "O", false, "run the peephole optimizer over compiled code")
+	fs.StringVar(&numbers, "numbers", "ieee", "arithmetic mode: ieee, or strict to make division by zero and NaN runtime errors")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: glox [command] [options] [script]\n\nCommands:\n")
+		for _, name := range commandOrder {
+			fmt.Fprintf(fs.Output(), "  %-8s %s\n", name, commands[name].summary)
+		}
+		fmt.Fprintf(fs.Output(), "\nOptions for %s:\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	// Accept options after the script too, as in "glox compile a.lox -o a.loxc".
+	var positional []string
+	for {
+		if err := fs.Parse(args); err == flag.ErrHelp {
+			return EX_OK
+		} else if err != nil {
+			return EX_USAGE
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	colorMode, err := utils.ParseColorMode(color)
 	if err != nil {
-		fmt.Printf("Failed to read file '%s'.\n", os.Args[1])
-		os.Exit(65)
+		utils.PrintfErr("%s\n", err.Error())
+		return EX_USAGE
+	}
+	utils.SetColorMode(colorMode)
+	if numberMode, err = vm.ParseNumberMode(numbers); err != nil {
+		utils.PrintfErr("%s\n", err.Error())
+		return EX_USAGE
+	}
+
+	if name != "run" && len(positional) != 1 || len(positional) > 1 {
+		fs.Usage()
+		return EX_USAGE
+	}
+	return cmd.run(positional)
+}
+
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		runREPL(stdin)
+		return EX_OK
 	}
+	return runFile(args[0])
+}
+
+func traceCommand(args []string) int {
+	trace = true
+	return runFile(args[0])
+}
 
-	interpret(bytes)
+func disasmCommand(args []string) int {
+	disassemble = true
+	return checkCommand(args)
 }
 
-func interpret(source []byte) InterpretResult {
-	function, ok := compiler.Compile(source, true)
+func compileCommand(args []string) int {
+	path := args[0]
+	source, ok := readSource(path)
 	if !ok {
-		return COMPILE_ERROR
+		return EX_DATAERR
+	}
+	function := compile(path, source, newMachine())
+	if function == nil {
+		return EX_DATAERR
 	}
 
-	fmt.Println("====================== output ======================")
-	if !vm.Do(function, false) {
-		return RUNTIME_ERROR
+	data, err := chunk.Encode(function)
+	if err != nil {
+		utils.PrintfErr("%s\n", err.Error())
+		return EX_SOFTWARE
+	}
+	if output == "" {
+		output = strings.TrimSuffix(path, ".lox") + ".loxc"
 	}
+	if err := ioutil.WriteFile(output, data, 0644); err != nil {
+		utils.PrintfErr("Failed to write file '%s'.\n", output)
+		return EX_CANTCREAT
+	}
+	return EX_OK
+}
+
+func checkCommand(args []string) int {
+	path := args[0]
+	source, ok := readSource(path)
+	if !ok {
+		return EX_DATAERR
+	}
+	if compile(path, source, newMachine()) == nil {
+		return EX_DATAERR
+	}
+	return EX_OK
+}
+
+func runFile(path string) int {
+	source, ok := readSource(path)
+	if !ok {
+		return EX_DATAERR
+	}
+	run := interpret
+	if chunk.IsBytecode(source) {
+		run = load
+	}
+	switch run(path, source) {
+	case vm.COMPILE_ERROR:
+		return EX_DATAERR
+	case vm.RUNTIME_ERROR:
+		return EX_SOFTWARE
+	}
+	return EX_OK
+}
 
-	return OK
+func readSource(path string) ([]byte, bool) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		utils.PrintfErr("Failed to read file '%s'.\n", path)
+		return nil, false
+	}
+	return source, true
+}
+
+func newMachine() *vm.VM {
+	return vm.New(vm.Options{
+		MaxFrames:    maxFrames,
+		MaxStack:     maxStack,
+		MaxHeapBytes: maxHeap,
+		GCGrowFactor: gcGrowFactor,
+		StressGC:     stressGC,
+		Disassemble:  disassemble,
+		Optimize:     optimize,
+		Trace:        trace,
+		Numbers:      numberMode,
+		Output:       stdout,
+	})
+}
+
+// compile reports any diagnostics for source and returns the compiled
+// script, or nil if it has errors.
+func compile(path string, source []byte, machine *vm.VM) *chunk.ObjFunction {
+	c := compiler.New(machine.Heap(), disassemble)
+	c.SetOptimize(optimize)
+	function, diagnostics := c.Compile(source)
+	if len(diagnostics) > 0 {
+		fmt.Fprint(stderr, (&vm.CompileError{Diagnostics: diagnostics}).Render(path, source, utils.StderrColor()))
+	}
+	return function
+}
+
+func interpret(path string, source []byte) vm.InterpretResult {
+	machine := newMachine()
+	function := compile(path, source, machine)
+	if function == nil {
+		return vm.COMPILE_ERROR
+	}
+
+	machine.SetSource(source)
+	return execute(path, source, machine, function)
+}
+
+// load runs a .loxc file written by the compile command.
+func load(path string, data []byte) vm.InterpretResult {
+	machine := newMachine()
+	function, err := chunk.Decode(data, machine.Heap())
+	if err != nil {
+		utils.PrintfErr("%s: %s\n", path, err.Error())
+		return vm.COMPILE_ERROR
+	}
+	return execute(path, nil, machine, function)
+}
+
+func execute(path string, source []byte, machine *vm.VM, function *chunk.ObjFunction) vm.InterpretResult {
+	result, err := machine.Execute(function)
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		fmt.Fprint(stderr, runtimeErr.Render(path, source, utils.StderrColor()))
+	} else if err != nil {
+		utils.PrintfErr("%s\n", err.Error())
+	}
+	return result
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, source string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	script := write("ok.lox", "print 1 + 2;\n")
+	bad := write("bad.lox", "print 1 +;\n")
+	fails := write("fails.lox", "print -\"a\";\n")
+	compiled := filepath.Join(dir, "ok.loxc")
+	missing := filepath.Join(dir, "missing.lox")
+
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"run", []string{script}, "", EX_OK, "3\n", ""},
+		{"run command", []string{"run", script}, "", EX_OK, "3\n", ""},
+		{"repl", nil, "var a = 4;\na * 2\n", EX_OK, "8\n", ""},
+		{"compile", []string{"compile", script, "-o", compiled}, "", EX_OK, "", ""},
+		{"run bytecode", []string{compiled}, "", EX_OK, "3\n", ""},
+		{"disasm", []string{"disasm", script}, "", EX_OK, "OP_PRINT", ""},
+		{"trace", []string{"trace", script}, "", EX_OK, "[ 3 ]", ""},
+		{"run disasm", []string{"-disasm", script}, "", EX_OK, "OP_PRINT", ""},
+		{"check", []string{"check", script}, "", EX_OK, "", ""},
+		{"help", []string{"-h"}, "", EX_OK, "", "Usage: glox"},
+
+		{"unknown flag", []string{"-nope", script}, "", EX_USAGE, "", "-nope"},
+		{"bad color", []string{"-color", "pink", script}, "", EX_USAGE, "", "invalid color mode"},
+		{"bad numbers", []string{"-numbers", "exact", script}, "", EX_USAGE, "", "invalid number mode"},
+		{"two scripts", []string{script, script}, "", EX_USAGE, "", "Usage: glox"},
+		{"no script", []string{"check"}, "", EX_USAGE, "", "Usage: glox"},
+		{"compile error", []string{bad}, "", EX_DATAERR, "", "Expect expression."},
+		{"check error", []string{"check", bad}, "", EX_DATAERR, "", "Expect expression."},
+		{"missing file", []string{"compile", missing}, "", EX_DATAERR, "", "Failed to read file"},
+		{"runtime error", []string{fails}, "", EX_SOFTWARE, "", "Operand must be a number."},
+		{"trace runtime error", []string{"trace", fails}, "", EX_SOFTWARE, "OP_NEGATE", "Operand must be a number."},
+		{"cannot write", []string{"compile", script, "-o", filepath.Join(dir, "no", "such", "dir.loxc")}, "", EX_CANTCREAT, "", "Failed to write file"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		args := append([]string{"-color", "never"}, test.args...)
+		if len(test.args) > 0 && commands[test.args[0]] != nil {
+			// Options follow the command name.
+			args = append([]string{test.args[0], "-color", "never"}, test.args[1:]...)
+		}
+		code := run(args, strings.NewReader(test.stdin), &stdout, &stderr)
+		if code != test.code {
+			t.Errorf("%s: exit code %d, want %d; stderr:\n%s", test.name, code, test.code, stderr.String())
+		}
+		if !strings.Contains(stdout.String(), test.stdout) || test.stdout == "" && stdout.Len() > 0 {
+			t.Errorf("%s: stdout %q, want %q", test.name, stdout.String(), test.stdout)
+		}
+		if !strings.Contains(stderr.String(), test.stderr) || test.stderr == "" && stderr.Len() > 0 {
+			t.Errorf("%s: stderr %q, want %q", test.name, stderr.String(), test.stderr)
+		}
+	}
+}
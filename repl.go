@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/Roderland/glox-vm/compiler"
+	"github.com/Roderland/glox-vm/utils"
+	"github.com/Roderland/glox-vm/vm"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const REPL_HELP = `Enter Lox statements; the value of an expression statement is printed.
+Input continues on the next line while a block, parenthesis or string is open.
+
+  :help       show this help
+  :dis        toggle disassembly of compiled code
+  :trace      toggle tracing of executed instructions
+  :reset      forget every global and start over
+  :history    list previous entries
+  !!          run the previous entry again
+  !N          run entry N again
+  :quit       leave (as does end of input)
+`
+
+// repl keeps one VM alive between entries so that globals persist. Every
+// entry is appended to transcript and compiled with its own line numbers, so
+// errors in functions defined by earlier entries still quote the right line.
+type repl struct {
+	machine     *vm.VM
+	transcript  []byte
+	line        int
+	history     []string
+	disassemble bool
+	trace       bool
+}
+
+func runREPL(in io.Reader) {
+	r := &repl{disassemble: disassemble, trace: trace}
+	r.reset()
+
+	reader := bufio.NewReader(in)
+	var entry strings.Builder
+	for {
+		if entry.Len() == 0 {
+			fmt.Fprint(stdout, "> ")
+		} else {
+			fmt.Fprint(stdout, "... ")
+		}
+
+		line, err := reader.ReadString('\n')
+		if line == "" && err != nil {
+			fmt.Fprintln(stdout)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if entry.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" {
+				continue
+			}
+			if strings.HasPrefix(trimmed, ":") || isRerun(trimmed) {
+				if !r.command(trimmed) {
+					return
+				}
+				continue
+			}
+		}
+
+		entry.WriteString(line)
+		entry.WriteString("\n")
+		if compiler.IsIncomplete([]byte(entry.String())) {
+			continue
+		}
+
+		source := entry.String()
+		entry.Reset()
+		r.history = append(r.history, strings.TrimRight(source, "\n"))
+		r.run(source)
+	}
+}
+
+// command runs a meta command and reports whether the REPL should go on.
+func (r *repl) command(cmd string) bool {
+	switch cmd {
+	case ":help":
+		fmt.Fprint(stdout, REPL_HELP)
+	case ":dis":
+		r.disassemble = !r.disassemble
+		fmt.Fprintf(stdout, "disassembly %s\n", onOff(r.disassemble))
+	case ":trace":
+		r.trace = !r.trace
+		r.machine.SetTrace(r.trace)
+		fmt.Fprintf(stdout, "tracing %s\n", onOff(r.trace))
+	case ":reset":
+		r.reset()
+		fmt.Fprintln(stdout, "all globals cleared")
+	case ":history":
+		for i, entry := range r.history {
+			fmt.Fprintf(stdout, "%4d  %s\n", i+1, strings.ReplaceAll(entry, "\n", "\n      "))
+		}
+	case ":quit":
+		return false
+	default:
+		if isRerun(cmd) {
+			r.rerun(cmd[1:])
+		} else {
+			utils.PrintfErr("Unknown command '%s', try :help.\n", cmd)
+		}
+	}
+	return true
+}
+
+// isRerun reports whether line is !! or !N rather than Lox code such as
+// !true;.
+func isRerun(line string) bool {
+	if line == "!!" {
+		return true
+	}
+	if len(line) < 2 || line[0] != '!' {
+		return false
+	}
+	for _, ch := range line[1:] {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *repl) rerun(which string) {
+	index := len(r.history)
+	if which != "!" {
+		n, err := strconv.Atoi(which)
+		if err != nil || n < 1 || n > len(r.history) {
+			utils.PrintfErr("No history entry '%s'.\n", which)
+			return
+		}
+		index = n
+	}
+	if index == 0 {
+		utils.PrintfErr("No history yet.\n")
+		return
+	}
+
+	entry := r.history[index-1]
+	fmt.Fprintln(stdout, entry)
+	r.history = append(r.history, entry)
+	r.run(entry + "\n")
+}
+
+func (r *repl) run(source string) {
+	firstLine := r.line
+	r.transcript = append(r.transcript, source...)
+	r.line += strings.Count(source, "\n")
+	r.machine.SetSource(r.transcript)
+
+	c := compiler.New(r.machine.Heap(), r.disassemble)
+	c.SetREPL(true)
+	c.SetOptimize(optimize)
+	c.SetFirstLine(firstLine)
+	function, diagnostics := c.Compile([]byte(source))
+	if len(diagnostics) > 0 {
+		fmt.Fprint(stderr, (&vm.CompileError{Diagnostics: diagnostics}).Render("<repl>", r.transcript, utils.StderrColor()))
+	}
+	if function == nil {
+		return
+	}
+
+	_, err := r.machine.Execute(function)
+	if runtimeErr, ok := err.(*vm.RuntimeError); ok {
+		fmt.Fprint(stderr, runtimeErr.Render("<repl>", r.transcript, utils.StderrColor()))
+	} else if err != nil {
+		utils.PrintfErr("%s\n", err.Error())
+	}
+}
+
+func (r *repl) reset() {
+	r.machine = newMachine()
+	r.machine.SetTrace(r.trace)
+	r.transcript = nil
+	r.line = 1
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+type ColorMode uint8
+
+const (
+	COLOR_AUTO ColorMode = iota
+	COLOR_ALWAYS
+	COLOR_NEVER
+)
+
+var stdoutColor, stderrColor bool
+
+func init() {
+	SetColorMode(COLOR_AUTO)
+}
+
+// ParseColorMode accepts the values of the --color flag.
+func ParseColorMode(s string) (ColorMode, error) {
+	switch s {
+	case "auto":
+		return COLOR_AUTO, nil
+	case "always":
+		return COLOR_ALWAYS, nil
+	case "never":
+		return COLOR_NEVER, nil
+	}
+	return COLOR_AUTO, fmt.Errorf("invalid color mode '%s', expected auto, always or never", s)
+}
+
+// SetColorMode decides whether output is colored. COLOR_AUTO colors a
+// stream only when it is a terminal and NO_COLOR is not set.
+func SetColorMode(mode ColorMode) {
+	switch mode {
+	case COLOR_ALWAYS:
+		stdoutColor, stderrColor = true, true
+	case COLOR_NEVER:
+		stdoutColor, stderrColor = false, false
+	default:
+		_, noColor := os.LookupEnv("NO_COLOR")
+		stdoutColor = !noColor && isTerminal(os.Stdout)
+		stderrColor = !noColor && isTerminal(os.Stderr)
+	}
+}
+
+// StderrColor reports whether output written to stderr should be colored.
+func StderrColor() bool {
+	return stderrColor
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
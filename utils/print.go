@@ -2,18 +2,53 @@ package utils
 
 import (
 	"fmt"
+	"io"
 	"os"
 )
 
+const (
+	COLOR_RED    = 31
+	COLOR_YELLOW = 33
+	COLOR_BLUE   = 34
+	COLOR_CYAN   = 36
+)
+
+// stdout and stderr are where PrintfDbg and PrintfErr write.
+var stdout, stderr io.Writer = os.Stdout, os.Stderr
+
+// SetOutput redirects debug and error output, so that a caller can capture
+// it. Color is still decided by SetColorMode.
+func SetOutput(out, err io.Writer) {
+	stdout, stderr = out, err
+}
+
 func PrintfDbg(format string, a ...interface{}) {
 	msg := fmt.Sprintf(format, a...)
-	fmt.Printf("%c[%d;%d;%dm%s%c[0m", 0x1B, 0, 0, 36, msg, 0x1B)
+	fmt.Fprint(stdout, Colorize(stdoutColor, COLOR_CYAN, msg))
 }
 
 func PrintfErr(format string, a ...interface{}) {
 	msg := fmt.Sprintf(format, a...)
-	_, err := fmt.Fprintf(os.Stderr, "%c[%d;%d;%dm%s%c[0m", 0x1B, 0, 0, 31, msg, 0x1B)
+	_, err := fmt.Fprint(stderr, Colorize(stderrColor, COLOR_RED, msg))
 	if err != nil {
 		return
 	}
 }
+
+// Colorize wraps msg in the ANSI escapes for color when enabled is set.
+func Colorize(enabled bool, color int, msg string) string {
+	if !enabled {
+		return msg
+	}
+	return fmt.Sprintf("%c[%d;%d;%dm%s%c[0m", 0x1B, 0, 0, color, msg, 0x1B)
+}
+
+// bold is like Colorize, but a color of 0 keeps the default color.
+func bold(enabled bool, color int, msg string) string {
+	if !enabled {
+		return msg
+	} else if color == 0 {
+		return fmt.Sprintf("%c[1m%s%c[0m", 0x1B, msg, 0x1B)
+	}
+	return fmt.Sprintf("%c[1;%dm%s%c[0m", 0x1B, color, msg, 0x1B)
+}
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Label points at a span of a single source line. Line and Column are
+// 1-based; a Length below 1 is drawn as a lone caret.
+type Label struct {
+	Line    int
+	Column  int
+	Length  int
+	Message string
+}
+
+// Snippet renders a message in the style of rustc:
+//
+//	error: Expect expression.
+//	 --> test.lox:2:9
+//	  |
+//	2 | print a +;
+//	  |         ^
+//
+// followed by a block for each note. file may be empty, and lines missing
+// from source are left out.
+func Snippet(file string, source []byte, severity string, message string, primary Label, notes []Label, color bool) string {
+	width := len(strconv.Itoa(primary.Line))
+	for _, note := range notes {
+		if w := len(strconv.Itoa(note.Line)); w > width {
+			width = w
+		}
+	}
+
+	var sb strings.Builder
+	severityColor := COLOR_RED
+	if severity == "warning" {
+		severityColor = COLOR_YELLOW
+	}
+	sb.WriteString(bold(color, severityColor, severity))
+	sb.WriteString(bold(color, 0, ": "+message))
+	sb.WriteString("\n")
+	writeLabel(&sb, file, source, primary, width, severityColor, color)
+
+	for _, note := range notes {
+		sb.WriteString(bold(color, COLOR_CYAN, "note"))
+		sb.WriteString(bold(color, 0, ": "+note.Message))
+		sb.WriteString("\n")
+		writeLabel(&sb, file, source, note, width, COLOR_CYAN, color)
+	}
+	return sb.String()
+}
+
+func writeLabel(sb *strings.Builder, file string, source []byte, label Label, width int, underlineColor int, color bool) {
+	gutter := strings.Repeat(" ", width)
+	location := fmt.Sprintf("%d:%d", label.Line, label.Column)
+	if file != "" {
+		location = file + ":" + location
+	}
+	sb.WriteString(fmt.Sprintf("%s%s %s\n", gutter, bold(color, COLOR_BLUE, "-->"), location))
+
+	text, ok := SourceLine(source, label.Line)
+	if !ok {
+		return
+	}
+	bar := bold(color, COLOR_BLUE, "|")
+	sb.WriteString(fmt.Sprintf("%s %s\n", gutter, bar))
+	sb.WriteString(fmt.Sprintf("%s %s %s\n", bold(color, COLOR_BLUE, fmt.Sprintf("%*d", width, label.Line)), bar, text))
+
+	// Spans running past the end of the line, like unterminated strings, are
+	// cut short there.
+	length := label.Length
+	if rest := len(text) - label.Column + 1; length > rest {
+		length = rest
+	}
+	underline := "^"
+	if length > 1 {
+		underline += strings.Repeat("~", length-1)
+	}
+	sb.WriteString(fmt.Sprintf("%s %s %s%s\n", gutter, bar, CaretPadding(text, label.Column), bold(color, underlineColor, underline)))
+}
+
+// SourceLine returns the text of the 1-based line in source without its line
+// terminator.
+func SourceLine(source []byte, line int) (string, bool) {
+	if line < 1 || source == nil {
+		return "", false
+	}
+	lines := strings.SplitN(string(source), "\n", line+1)
+	if len(lines) < line {
+		return "", false
+	}
+	return strings.TrimRight(lines[line-1], "\r"), true
+}
+
+// CaretPadding returns the whitespace that lines a caret up under the 1-based
+// byte column of text. Tabs are kept so the alignment survives them.
+func CaretPadding(text string, column int) string {
+	if column < 1 {
+		column = 1
+	}
+	if column-1 < len(text) {
+		text = text[:column-1]
+	}
+	var sb strings.Builder
+	for _, r := range text {
+		if r == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	for i := len(text); i < column-1; i++ {
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
@@ -0,0 +1,24 @@
+package utils
+
+import "testing"
+
+func TestSnippet(t *testing.T) {
+	source := []byte("var a = 1;\n\tprint a +;\n")
+	got := Snippet("test.lox", source, "error", "Expect expression.",
+		Label{Line: 2, Column: 11, Length: 1},
+		[]Label{{Line: 1, Column: 5, Length: 1, Message: "variable declared here"}}, false)
+
+	want := "error: Expect expression.\n" +
+		" --> test.lox:2:11\n" +
+		"  |\n" +
+		"2 | \tprint a +;\n" +
+		"  | \t         ^\n" +
+		"note: variable declared here\n" +
+		" --> test.lox:1:5\n" +
+		"  |\n" +
+		"1 | var a = 1;\n" +
+		"  |     ^\n"
+	if got != want {
+		t.Errorf("unexpected snippet:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/Roderland/glox-vm/compiler"
+	"github.com/Roderland/glox-vm/utils"
+	"strings"
+)
+
+type InterpretResult uint8
+
+const (
+	OK InterpretResult = iota
+	COMPILE_ERROR
+	RUNTIME_ERROR
+)
+
+// CompileError is returned by Interpret when the source does not compile.
+// Diagnostics holds every error and warning the compiler reported.
+type CompileError struct {
+	Diagnostics []compiler.Diagnostic
+}
+
+func (e *CompileError) Error() string {
+	var sb strings.Builder
+	for i, d := range e.Diagnostics {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(d.Error())
+	}
+	return sb.String()
+}
+
+// Render formats every diagnostic with its source snippet, see
+// compiler.Diagnostic.Render.
+func (e *CompileError) Render(file string, source []byte, color bool) string {
+	var sb strings.Builder
+	for _, d := range e.Diagnostics {
+		sb.WriteString(d.Render(file, source, color))
+	}
+	return sb.String()
+}
+
+// RuntimeError is returned when a script fails while running. Line, Column
+// and Function locate the failing instruction; StackTrace lists every active
+// call, innermost first. SourceLine is the text of the failing line, or empty
+// if the VM was not given the source.
+type RuntimeError struct {
+	Message    string
+	Line       int
+	Column     int
+	Function   string
+	SourceLine string
+	StackTrace []TraceFrame
+}
+
+// TraceFrame is one call in a runtime stack trace. Function is empty for
+// top-level code.
+type TraceFrame struct {
+	Function string
+	Line     int
+	Column   int
+}
+
+func (e *RuntimeError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(e.Message)
+	if e.SourceLine != "" {
+		sb.WriteString("\n    ")
+		sb.WriteString(e.SourceLine)
+		sb.WriteString("\n    ")
+		sb.WriteString(utils.CaretPadding(e.SourceLine, e.Column))
+		sb.WriteString("^")
+	}
+	for _, frame := range e.StackTrace {
+		sb.WriteString("\n")
+		sb.WriteString(frame.String())
+	}
+	return sb.String()
+}
+
+// Render formats the error with the failing line of source, which must be the
+// source the script was compiled from, followed by the stack trace.
+func (e *RuntimeError) Render(file string, source []byte, color bool) string {
+	var sb strings.Builder
+	sb.WriteString(utils.Snippet(file, source, "error", e.Message, utils.Label{Line: e.Line, Column: e.Column}, nil, color))
+	for _, frame := range e.StackTrace {
+		sb.WriteString(frame.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func (tf TraceFrame) String() string {
+	if tf.Function == "" {
+		return fmt.Sprintf("[line %d] in script", tf.Line)
+	}
+	return fmt.Sprintf("[line %d] in %s()", tf.Line, tf.Function)
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"fmt"
+	"github.com/Roderland/glox-vm/chunk"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	DEFAULT_MAX_FRAME = 64
+	FRAME_STACK_SLOTS = math.MaxUint8 + 1
+)
+
+// NumberMode selects what arithmetic does with zero divisors and NaN.
+type NumberMode uint8
+
+const (
+	// NUMBER_IEEE follows IEEE 754, so 1 / 0 is +Inf and 0 / 0 is NaN.
+	NUMBER_IEEE NumberMode = iota
+	// NUMBER_STRICT makes division or modulo by zero, and any arithmetic
+	// that produces NaN, a runtime error.
+	NUMBER_STRICT
+)
+
+// ParseNumberMode accepts the values of the --numbers flag.
+func ParseNumberMode(s string) (NumberMode, error) {
+	switch s {
+	case "ieee":
+		return NUMBER_IEEE, nil
+	case "strict":
+		return NUMBER_STRICT, nil
+	}
+	return NUMBER_IEEE, fmt.Errorf("invalid number mode '%s', expected ieee or strict", s)
+}
+
+// Options bounds the resources a single VM may use. Zero fields fall back to
+// the defaults.
+type Options struct {
+	// MaxFrames is the deepest call nesting allowed before "Stack overflow.".
+	MaxFrames int
+	// MaxStack is the most value stack slots the VM may grow to. It defaults
+	// to enough slots for MaxFrames frames that each use every local slot.
+	MaxStack int
+	// MaxHeapBytes caps the heap; 0 means unlimited.
+	MaxHeapBytes int
+	// GCGrowFactor and StressGC configure the collector, see chunk.Heap.
+	GCGrowFactor int
+	StressGC     bool
+	// Disassemble prints the bytecode of every function Interpret compiles.
+	Disassemble bool
+	// Optimize makes Interpret run the peephole optimizer, see
+	// chunk.Optimize.
+	Optimize bool
+	// Trace prints the stack and each instruction as it executes.
+	Trace bool
+	// Numbers is the arithmetic mode; the default is NUMBER_IEEE.
+	Numbers NumberMode
+	// Output receives what print statements write; the default is os.Stdout.
+	Output io.Writer
+}
+
+// initialStackSize is how many value stack slots a VM starts with before
+// growing towards maxStack.
+func initialStackSize(maxStack int) int {
+	if maxStack < FRAME_STACK_SLOTS {
+		return maxStack
+	}
+	return FRAME_STACK_SLOTS
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = DEFAULT_MAX_FRAME
+	}
+	if opts.MaxStack <= 0 {
+		opts.MaxStack = opts.MaxFrames * FRAME_STACK_SLOTS
+	}
+	if opts.GCGrowFactor <= 0 {
+		opts.GCGrowFactor = chunk.DEFAULT_GROW_FACTOR
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	return opts
+}
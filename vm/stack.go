@@ -3,35 +3,62 @@ package vm
 import (
 	"github.com/Roderland/glox-vm/chunk"
 	"github.com/Roderland/glox-vm/utils"
-	"math"
 )
 
-const STACK_MAX = math.MaxUint8
+// stackFault is raised by the stack helpers when an access would leave the
+// bounds of the value stack. Run recovers it and reports it as a runtime
+// error, so neither deep recursion nor malformed bytecode can panic the host.
+type stackFault struct {
+	msg string
+}
 
 func (vm *VM) stackPush(value chunk.Value) {
-	if vm.stackSize() >= STACK_MAX {
-		// todo
+	if vm.stackTop >= len(vm.stack) {
+		vm.growStack()
 	}
-	vm.stack = append(vm.stack, value)
+	vm.stack[vm.stackTop] = value
+	vm.stackTop++
 }
 
 func (vm *VM) stackPop() chunk.Value {
-	idx := len(vm.stack) - 1
-	value := vm.stack[idx]
-	vm.stack = vm.stack[:idx]
-	return value
+	if vm.stackTop == 0 {
+		panic(stackFault{"Stack underflow."})
+	}
+	vm.stackTop--
+	return vm.stack[vm.stackTop]
 }
 
 func (vm *VM) stackPeek(distance int) chunk.Value {
-	return vm.stack[vm.stackSize()-distance-1]
+	idx := vm.stackTop - distance - 1
+	if idx < 0 || idx >= vm.stackTop {
+		panic(stackFault{"Stack underflow."})
+	}
+	return vm.stack[idx]
+}
+
+// growStack doubles the value stack, up to maxStack slots. The stack starts
+// small so that allowing deep recursion costs nothing until a script uses it.
+func (vm *VM) growStack() {
+	if len(vm.stack) >= vm.maxStack {
+		panic(stackFault{"Stack overflow."})
+	}
+	size := len(vm.stack) * 2
+	if size > vm.maxStack {
+		size = vm.maxStack
+	}
+	stack := make([]chunk.Value, size)
+	copy(stack, vm.stack[:vm.stackTop])
+	vm.stack = stack
 }
 
 func (vm *VM) stackSize() int {
-	return len(vm.stack)
+	return vm.stackTop
 }
 
 func (vm *VM) stackReset() {
-	vm.stack = []chunk.Value{}
+	vm.stackTop = 0
+	vm.frameCount = 0
+	vm.openUpvalues = nil
 }
 
 func (vm *VM) stackInfo() {
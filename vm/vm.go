@@ -1,59 +1,160 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Roderland/glox-vm/chunk"
+	"github.com/Roderland/glox-vm/compiler"
 	"github.com/Roderland/glox-vm/utils"
+	"io"
+	"math"
 	"time"
 )
 
-const MAX_FRAME = 64
-
 type VM struct {
-	frames     [MAX_FRAME]CallFrame
-	frameCount int
-	stack      []chunk.Value
-	globals    map[string]chunk.Value
+	frames       []CallFrame
+	frameCount   int
+	maxFrames    int
+	maxStack     int
+	stack        []chunk.Value
+	stackTop     int
+	globals      chunk.Table
+	initString   *chunk.ObjString
+	openUpvalues *chunk.ObjUpvalue
+	heap         *chunk.Heap
+	disassemble  bool
+	optimize     bool
+	trace        bool
+	numbers      NumberMode
+	output       io.Writer
+	source       []byte
+	err          *RuntimeError
 }
 
 type CallFrame struct {
-	function  *chunk.ObjFunction
+	closure   *chunk.ObjClosure
 	ip        int
 	stackSlot int
 }
 
-func Do(function *chunk.ObjFunction, debugMode bool) bool {
-	vm := initVM()
-	vm.stackPush(chunk.NewObject(chunk.NewFunction(*function)))
-	vm.call(*function, 0)
-	vm.frames[vm.frameCount].function = function
-	vm.frames[vm.frameCount].ip = 0
-	vm.frames[vm.frameCount].stackSlot = 0
-	return vm.Run(debugMode)
-}
+// New creates a VM with its own heap. A VM can interpret any number of
+// scripts; globals defined by one are visible to the next.
+func New(opts Options) *VM {
+	opts = opts.withDefaults()
+
+	heap := chunk.NewHeap()
+	heap.GrowFactor = opts.GCGrowFactor
+	heap.StressGC = opts.StressGC
 
-func initVM() *VM {
 	vm := &VM{
-		frames:     [MAX_FRAME]CallFrame{},
-		frameCount: 0,
-		stack:      []chunk.Value{},
-		globals:    map[string]chunk.Value{},
+		frames:      make([]CallFrame, 0, DEFAULT_MAX_FRAME),
+		frameCount:  0,
+		maxFrames:   opts.MaxFrames,
+		maxStack:    opts.MaxStack,
+		stack:       make([]chunk.Value, initialStackSize(opts.MaxStack)),
+		heap:        heap,
+		disassemble: opts.Disassemble,
+		optimize:    opts.Optimize,
+		trace:       opts.Trace,
+		numbers:     opts.Numbers,
+		output:      opts.Output,
 	}
-	vm.defineNative("clock", clockNative)
+	heap.PushRoots(vm.markRoots)
+	heap.TrackTable(&vm.globals)
+
+	vm.initString = vm.heap.InternString("init")
+	vm.DefineNative("clock", 0, clockNative)
+	vm.DefineNative("isNaN", 1, isNaNNative)
+	vm.DefineNative("isInfinite", 1, isInfiniteNative)
+	// The limit applies from here on, so what the VM needs to start never
+	// fails; a limit below it makes every later allocation fail instead.
+	heap.MaxBytes = opts.MaxHeapBytes
 	return vm
 }
 
-func (vm *VM) Run(debugMode bool) bool {
+func (vm *VM) Heap() *chunk.Heap {
+	return vm.heap
+}
+
+// SetTrace turns instruction tracing on or off for later calls to Execute.
+func (vm *VM) SetTrace(trace bool) {
+	vm.trace = trace
+}
+
+// SetSource tells the VM which source the functions passed to Execute were
+// compiled from, so that runtime errors can quote the failing line.
+func (vm *VM) SetSource(source []byte) {
+	vm.source = source
+}
+
+// Interpret compiles and runs source. Errors are returned as *CompileError
+// or *RuntimeError rather than printed, leaving reporting to the caller.
+func (vm *VM) Interpret(source []byte) (InterpretResult, error) {
+	vm.source = source
+	c := compiler.New(vm.heap, vm.disassemble)
+	c.SetOptimize(vm.optimize)
+	function, diagnostics := c.Compile(source)
+	if function == nil {
+		return COMPILE_ERROR, &CompileError{Diagnostics: diagnostics}
+	}
+	return vm.execute(function)
+}
+
+// Execute runs a top-level script function that was compiled or loaded into
+// the VM's heap. Since the function may come from anywhere, it is checked
+// with chunk.Verify first and rejected with a *chunk.VerifyError if invalid.
+func (vm *VM) Execute(function *chunk.ObjFunction) (InterpretResult, error) {
+	if err := chunk.Verify(function); err != nil {
+		return RUNTIME_ERROR, err
+	}
+	return vm.execute(function)
+}
+
+func (vm *VM) execute(function *chunk.ObjFunction) (InterpretResult, error) {
+	vm.stackPush(chunk.NewObject(&function.Object))
+	var closure *chunk.Object
+	if err := catchOutOfMemory(func() { closure = vm.heap.Allocate(chunk.NewClosure(function)) }); err != nil {
+		vm.stackReset()
+		return RUNTIME_ERROR, &RuntimeError{Message: "Out of memory."}
+	}
+	vm.stackPop()
+	vm.stackPush(chunk.NewObject(closure))
+	if !vm.call(closure.AsClosure(), 0) || !vm.Run(vm.trace) {
+		err := vm.err
+		vm.err = nil
+		return RUNTIME_ERROR, err
+	}
+	return OK, nil
+}
+
+func (vm *VM) Run(debugMode bool) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch fault := r.(type) {
+			case stackFault:
+				vm.runtimeError(fault.msg)
+			case chunk.OutOfMemory:
+				vm.runtimeError("Out of memory.")
+			default:
+				// Verified code should never get here, but a bug in the vm
+				// must not take down the program embedding it.
+				vm.runtimeError("Internal error: %v.", r)
+			}
+			ok = false
+		}
+	}()
+
 	for {
 		// if debug mode is turned on, trace program execution
 		if debugMode {
 			vm.stackInfo()
-			chunk.DisAsmInstruction(&(vm.frames[vm.frameCount-1].function.Ck), vm.frames[vm.frameCount-1].ip)
+			chunk.DisAsmInstruction(&(vm.frames[vm.frameCount-1].closure.Function.Ck), vm.frames[vm.frameCount-1].ip)
 		}
 		instruction := vm.readByte()
 		switch instruction {
 		case chunk.OP_RETURN:
 			result := vm.stackPop()
+			vm.closeUpvalues(vm.frames[vm.frameCount-1].stackSlot)
 			vm.frameCount--
 			if vm.frameCount == 0 {
 				vm.stackPop()
@@ -61,7 +162,7 @@ func (vm *VM) Run(debugMode bool) bool {
 			}
 
 			stackLength := vm.frames[vm.frameCount].stackSlot
-			vm.stack = vm.stack[:stackLength]
+			vm.stackTop = stackLength
 			vm.stackPush(result)
 			// frame = &vm.frames[vm.frameCount-1]
 
@@ -69,6 +170,9 @@ func (vm *VM) Run(debugMode bool) bool {
 			constant := vm.readConstant()
 			vm.stackPush(constant)
 
+		case chunk.OP_CONSTANT_LONG:
+			vm.stackPush(vm.readConstantLong())
+
 		case chunk.OP_NEGATE:
 			if !vm.stackPeek(0).IsNumber() {
 				vm.runtimeError("Operand must be a number.")
@@ -76,17 +180,33 @@ func (vm *VM) Run(debugMode bool) bool {
 			}
 			vm.stackPush(chunk.NewNumber(-vm.stackPop().AsNumber()))
 
+		case chunk.OP_BIT_NOT:
+			a, ok := chunk.ToInteger(vm.stackPeek(0))
+			if !ok {
+				vm.runtimeError("Operand must be an integer.")
+				return false
+			}
+			vm.stackPop()
+			vm.stackPush(chunk.NewNumber(float64(^a)))
+
 		case chunk.OP_ADD:
 			if vm.stackPeek(0).IsNumber() && vm.stackPeek(1).IsNumber() {
 				b := vm.stackPop().AsNumber()
 				a := vm.stackPop().AsNumber()
-				vm.stackPush(chunk.NewNumber(a + b))
+				if !vm.pushNumber(a + b) {
+					return false
+				}
 				break
 			}
 			if vm.stackPeek(0).IsString() && vm.stackPeek(1).IsString() {
-				b := vm.stackPop().AsString()
-				a := vm.stackPop().AsString()
-				vm.stackPush(chunk.NewString(a + b))
+				// Both operands stay on the stack until the result is
+				// allocated, in case that triggers a collection.
+				b := vm.stackPeek(0).AsString()
+				a := vm.stackPeek(1).AsString()
+				result := vm.heap.InternString(a.Chars + b.Chars)
+				vm.stackPop()
+				vm.stackPop()
+				vm.stackPush(chunk.NewObject(&result.Object))
 				break
 			}
 			vm.runtimeError("Operands must be numbers or strings.")
@@ -97,21 +217,89 @@ func (vm *VM) Run(debugMode bool) bool {
 			if !ok {
 				return false
 			}
-			vm.stackPush(chunk.NewNumber(a - b))
+			if !vm.pushNumber(a - b) {
+				return false
+			}
 
 		case chunk.OP_MULTIPLY:
 			a, b, ok := vm.popBinaryNumber()
 			if !ok {
 				return false
 			}
-			vm.stackPush(chunk.NewNumber(a * b))
+			if !vm.pushNumber(a * b) {
+				return false
+			}
 
 		case chunk.OP_DIVIDE:
 			a, b, ok := vm.popBinaryNumber()
 			if !ok {
 				return false
 			}
-			vm.stackPush(chunk.NewNumber(a / b))
+			if !vm.checkDivisor(b, "Division by zero.") || !vm.pushNumber(a/b) {
+				return false
+			}
+
+		case chunk.OP_MODULO:
+			a, b, ok := vm.popBinaryNumber()
+			if !ok {
+				return false
+			}
+			if !vm.checkDivisor(b, "Modulo by zero.") || !vm.pushNumber(chunk.Modulo(a, b)) {
+				return false
+			}
+
+		case chunk.OP_FLOOR_DIVIDE:
+			a, b, ok := vm.popBinaryNumber()
+			if !ok {
+				return false
+			}
+			if !vm.checkDivisor(b, "Division by zero.") || !vm.pushNumber(chunk.FloorDivide(a, b)) {
+				return false
+			}
+
+		case chunk.OP_POWER:
+			a, b, ok := vm.popBinaryNumber()
+			if !ok {
+				return false
+			}
+			if !vm.pushNumber(math.Pow(a, b)) {
+				return false
+			}
+
+		case chunk.OP_BIT_AND:
+			a, b, ok := vm.popBinaryInteger()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewNumber(float64(a & b)))
+
+		case chunk.OP_BIT_OR:
+			a, b, ok := vm.popBinaryInteger()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewNumber(float64(a | b)))
+
+		case chunk.OP_BIT_XOR:
+			a, b, ok := vm.popBinaryInteger()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewNumber(float64(a ^ b)))
+
+		case chunk.OP_SHIFT_LEFT:
+			a, b, ok := vm.popShift()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewNumber(float64(a << b)))
+
+		case chunk.OP_SHIFT_RIGHT:
+			a, b, ok := vm.popShift()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewNumber(float64(a >> b)))
 
 		case chunk.OP_NIL:
 			vm.stackPush(chunk.Nil)
@@ -142,34 +330,54 @@ func (vm *VM) Run(debugMode bool) bool {
 			}
 			vm.stackPush(chunk.NewBool(a < b))
 
+		case chunk.OP_NOT_EQUAL:
+			b := vm.stackPop()
+			a := vm.stackPop()
+			vm.stackPush(chunk.NewBool(!chunk.Equal(a, b)))
+
+		// These mirror the OP_LESS OP_NOT and OP_GREATER OP_NOT pairs they
+		// replace, so comparisons with NaN give the same answer either way.
+		case chunk.OP_GREATER_EQUAL:
+			a, b, ok := vm.popBinaryNumber()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewBool(!(a < b)))
+
+		case chunk.OP_LESS_EQUAL:
+			a, b, ok := vm.popBinaryNumber()
+			if !ok {
+				return false
+			}
+			vm.stackPush(chunk.NewBool(!(a > b)))
+
 		case chunk.OP_PRINT:
-			fmt.Println(vm.stackPop().String())
+			fmt.Fprintln(vm.output, vm.stackPop().String())
 
 		case chunk.OP_POP:
 			vm.stackPop()
 
-		case chunk.OP_DEFINE_GLOBAL:
-			name := vm.readConstant().AsString()
-			vm.globals[name] = vm.stackPeek(0)
+		case chunk.OP_DEFINE_GLOBAL, chunk.OP_DEFINE_GLOBAL_LONG:
+			name := vm.readName(instruction == chunk.OP_DEFINE_GLOBAL_LONG)
+			vm.globals.Set(name, vm.stackPeek(0))
 			vm.stackPop()
 
-		case chunk.OP_GET_GLOBAL:
-			name := vm.readConstant().AsString()
-			val, ok := vm.globals[name]
+		case chunk.OP_GET_GLOBAL, chunk.OP_GET_GLOBAL_LONG:
+			name := vm.readName(instruction == chunk.OP_GET_GLOBAL_LONG)
+			val, ok := vm.globals.Get(name)
 			if !ok {
-				vm.runtimeError("Undefined variable '%s'.", name)
+				vm.runtimeError("Undefined variable '%s'.", name.Chars)
 				return false
 			}
 			vm.stackPush(val)
 
-		case chunk.OP_SET_GLOBAL:
-			name := vm.readConstant().AsString()
-			_, ok := vm.globals[name]
-			if !ok {
-				vm.runtimeError("Undefined variable '%s'.", name)
+		case chunk.OP_SET_GLOBAL, chunk.OP_SET_GLOBAL_LONG:
+			name := vm.readName(instruction == chunk.OP_SET_GLOBAL_LONG)
+			if vm.globals.Set(name, vm.stackPeek(0)) {
+				vm.globals.Delete(name)
+				vm.runtimeError("Undefined variable '%s'.", name.Chars)
 				return false
 			}
-			vm.globals[name] = vm.stackPeek(0)
 
 		case chunk.OP_GET_LOCAL:
 			slot := vm.frames[vm.frameCount-1].stackSlot + int(vm.readByte())
@@ -185,6 +393,12 @@ func (vm *VM) Run(debugMode bool) bool {
 				vm.frames[vm.frameCount-1].ip += int(offset)
 			}
 
+		case chunk.OP_POP_JUMP_IF_FALSE:
+			offset := vm.readShort()
+			if vm.stackPop().IsFalse() {
+				vm.frames[vm.frameCount-1].ip += int(offset)
+			}
+
 		case chunk.OP_JUMP:
 			offset := vm.readShort()
 			vm.frames[vm.frameCount-1].ip += int(offset)
@@ -199,6 +413,130 @@ func (vm *VM) Run(debugMode bool) bool {
 				return false
 			}
 			// frame = &vm.frames[vm.frameCount - 1];
+
+		case chunk.OP_CLOSURE, chunk.OP_CLOSURE_LONG:
+			function := vm.readConstantOperand(instruction == chunk.OP_CLOSURE_LONG).AsObject().AsFunction()
+			obj := vm.heap.Allocate(chunk.NewClosure(function))
+			vm.stackPush(chunk.NewObject(obj))
+
+			frame := &vm.frames[vm.frameCount-1]
+			closure := obj.AsClosure()
+			for i := range closure.Upvalues {
+				isLocal := vm.readByte()
+				index := int(vm.readByte())
+				if isLocal == 1 {
+					closure.Upvalues[i] = vm.captureUpvalue(frame.stackSlot + index)
+				} else {
+					closure.Upvalues[i] = frame.closure.Upvalues[index]
+				}
+			}
+
+		case chunk.OP_GET_UPVALUE:
+			upvalue := vm.frames[vm.frameCount-1].closure.Upvalues[vm.readByte()]
+			if upvalue.IsOpen() {
+				vm.stackPush(vm.stack[upvalue.Location])
+			} else {
+				vm.stackPush(upvalue.Closed)
+			}
+
+		case chunk.OP_SET_UPVALUE:
+			upvalue := vm.frames[vm.frameCount-1].closure.Upvalues[vm.readByte()]
+			if upvalue.IsOpen() {
+				vm.stack[upvalue.Location] = vm.stackPeek(0)
+			} else {
+				upvalue.Closed = vm.stackPeek(0)
+			}
+
+		case chunk.OP_CLOSE_UPVALUE:
+			vm.closeUpvalues(vm.stackSize() - 1)
+			vm.stackPop()
+
+		case chunk.OP_CLASS, chunk.OP_CLASS_LONG:
+			class := vm.heap.Allocate(chunk.NewClass(vm.readName(instruction == chunk.OP_CLASS_LONG).Chars))
+			vm.stackPush(chunk.NewObject(class))
+
+		case chunk.OP_GET_PROPERTY, chunk.OP_GET_PROPERTY_LONG:
+			if !vm.stackPeek(0).IsObject() || !vm.stackPeek(0).AsObject().IsInstance() {
+				vm.runtimeError("Only instances have properties.")
+				return false
+			}
+
+			instance := vm.stackPeek(0).AsObject().AsInstance()
+			name := vm.readName(instruction == chunk.OP_GET_PROPERTY_LONG)
+			if value, ok := instance.Fields.Get(name); ok {
+				vm.stackPop()
+				vm.stackPush(value)
+				break
+			}
+
+			if !vm.bindMethod(instance.Class, name) {
+				return false
+			}
+
+		case chunk.OP_SET_PROPERTY, chunk.OP_SET_PROPERTY_LONG:
+			if !vm.stackPeek(1).IsObject() || !vm.stackPeek(1).AsObject().IsInstance() {
+				vm.runtimeError("Only instances have fields.")
+				return false
+			}
+
+			instance := vm.stackPeek(1).AsObject().AsInstance()
+			instance.Fields.Set(vm.readName(instruction == chunk.OP_SET_PROPERTY_LONG), vm.stackPeek(0))
+			value := vm.stackPop()
+			vm.stackPop()
+			vm.stackPush(value)
+
+		case chunk.OP_METHOD, chunk.OP_METHOD_LONG:
+			name := vm.readName(instruction == chunk.OP_METHOD_LONG)
+			class, ok := vm.peekClass(1, "Methods can only be defined on classes.")
+			if !ok {
+				return false
+			}
+			class.Methods.Set(name, vm.stackPeek(0))
+			vm.stackPop()
+
+		case chunk.OP_INVOKE, chunk.OP_INVOKE_LONG:
+			method := vm.readName(instruction == chunk.OP_INVOKE_LONG)
+			argCount := int(vm.readByte())
+			if !vm.invoke(method, argCount) {
+				return false
+			}
+
+		case chunk.OP_INHERIT:
+			superclass := vm.stackPeek(1)
+			if !superclass.IsObject() || !superclass.AsObject().IsClass() {
+				vm.runtimeError("Superclass must be a class.")
+				return false
+			}
+
+			subclass, ok := vm.peekClass(0, "Subclass must be a class.")
+			if !ok {
+				return false
+			}
+			superclass.AsObject().AsClass().Methods.AddAll(&subclass.Methods)
+			vm.stackPop()
+
+		case chunk.OP_GET_SUPER, chunk.OP_GET_SUPER_LONG:
+			name := vm.readName(instruction == chunk.OP_GET_SUPER_LONG)
+			superclass, ok := vm.peekClass(0, "Superclass must be a class.")
+			if !ok {
+				return false
+			}
+			vm.stackPop()
+			if !vm.bindMethod(superclass, name) {
+				return false
+			}
+
+		case chunk.OP_SUPER_INVOKE, chunk.OP_SUPER_INVOKE_LONG:
+			method := vm.readName(instruction == chunk.OP_SUPER_INVOKE_LONG)
+			argCount := int(vm.readByte())
+			superclass, ok := vm.peekClass(0, "Superclass must be a class.")
+			if !ok {
+				return false
+			}
+			vm.stackPop()
+			if !vm.invokeFromClass(superclass, method, argCount) {
+				return false
+			}
 		}
 	}
 }
@@ -206,15 +544,43 @@ func (vm *VM) Run(debugMode bool) bool {
 func (vm *VM) callValue(callee chunk.Value, argCount int) bool {
 	if callee.IsObject() {
 		obj := callee.AsObject()
-		if obj.IsFunction() {
-			return vm.call(obj.AsFunction(), argCount)
+		if obj.IsClosure() {
+			return vm.call(obj.AsClosure(), argCount)
+		}
+		if obj.IsBoundMethod() {
+			bound := obj.AsBoundMethod()
+			vm.stack[vm.stackSize()-argCount-1] = bound.Receiver
+			return vm.call(bound.Method, argCount)
+		}
+		if obj.IsClass() {
+			class := obj.AsClass()
+			instance := vm.heap.Allocate(chunk.NewInstance(class))
+			vm.stack[vm.stackSize()-argCount-1] = chunk.NewObject(instance)
+			if initializer, ok := class.Methods.Get(vm.initString); ok {
+				closure, ok := vm.methodClosure(initializer)
+				return ok && vm.call(closure, argCount)
+			} else if argCount != 0 {
+				vm.runtimeError("Expected 0 arguments but got %d.", argCount)
+				return false
+			}
+			return true
 		}
 		if obj.IsNative() {
 			native := obj.AsNative()
-			start := len(vm.stack) - argCount
-			result := native(vm.stack[start:]...)
+			if native.Arity != chunk.VARIADIC && argCount != native.Arity {
+				vm.runtimeError("Expected %d arguments but got %d.", native.Arity, argCount)
+				return false
+			}
 
-			vm.stack = vm.stack[:start]
+			start := vm.stackSize() - argCount
+			result, err := native.Function(vm.stack[start:vm.stackTop]...)
+			if err != nil {
+				vm.runtimeError("%s", err.Error())
+				return false
+			}
+
+			// Discard the arguments and the native itself.
+			vm.stackTop = start - 1
 			vm.stackPush(result)
 			return true
 		}
@@ -223,25 +589,123 @@ func (vm *VM) callValue(callee chunk.Value, argCount int) bool {
 	return false
 }
 
-func (vm *VM) call(f chunk.ObjFunction, argCount int) bool {
-	if argCount != f.Arity {
-		vm.runtimeError("Expected %d arguments but got %d.", f.Arity, argCount)
+func (vm *VM) invoke(name *chunk.ObjString, argCount int) bool {
+	receiver := vm.stackPeek(argCount)
+	if !receiver.IsObject() || !receiver.AsObject().IsInstance() {
+		vm.runtimeError("Only instances have methods.")
+		return false
+	}
+
+	instance := receiver.AsObject().AsInstance()
+	if value, ok := instance.Fields.Get(name); ok {
+		vm.stack[vm.stackSize()-argCount-1] = value
+		return vm.callValue(value, argCount)
+	}
+
+	return vm.invokeFromClass(instance.Class, name, argCount)
+}
+
+func (vm *VM) invokeFromClass(class *chunk.ObjClass, name *chunk.ObjString, argCount int) bool {
+	method, ok := class.Methods.Get(name)
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name.Chars)
+		return false
+	}
+	closure, ok := vm.methodClosure(method)
+	return ok && vm.call(closure, argCount)
+}
+
+func (vm *VM) bindMethod(class *chunk.ObjClass, name *chunk.ObjString) bool {
+	method, ok := class.Methods.Get(name)
+	if !ok {
+		vm.runtimeError("Undefined property '%s'.", name.Chars)
 		return false
 	}
 
-	if vm.frameCount == MAX_FRAME {
+	closure, ok := vm.methodClosure(method)
+	if !ok {
+		return false
+	}
+	bound := vm.heap.Allocate(chunk.NewBoundMethod(vm.stackPeek(0), closure))
+	vm.stackPop()
+	vm.stackPush(chunk.NewObject(bound))
+	return true
+}
+
+// peekClass returns the class distance slots down the stack, or reports
+// message if the value there is not one. The compiler never emits code that
+// fails this, but loaded bytecode might.
+func (vm *VM) peekClass(distance int, message string) (*chunk.ObjClass, bool) {
+	value := vm.stackPeek(distance)
+	if !value.IsObject() || !value.AsObject().IsClass() {
+		vm.runtimeError("%s", message)
+		return nil, false
+	}
+	return value.AsObject().AsClass(), true
+}
+
+// methodClosure checks that a value from a method table is a closure.
+func (vm *VM) methodClosure(method chunk.Value) (*chunk.ObjClosure, bool) {
+	if !method.IsObject() || !method.AsObject().IsClosure() {
+		vm.runtimeError("Methods must be functions.")
+		return nil, false
+	}
+	return method.AsObject().AsClosure(), true
+}
+
+func (vm *VM) call(closure *chunk.ObjClosure, argCount int) bool {
+	if argCount != closure.Function.Arity {
+		vm.runtimeError("Expected %d arguments but got %d.", closure.Function.Arity, argCount)
+		return false
+	}
+
+	if vm.frameCount == vm.maxFrames {
 		vm.runtimeError("Stack overflow.")
 		return false
 	}
+	if vm.frameCount == len(vm.frames) {
+		vm.frames = append(vm.frames, CallFrame{})
+	}
 
 	frame := &vm.frames[vm.frameCount]
 	vm.frameCount++
-	frame.function = &f
+	frame.closure = closure
 	frame.ip = 0
 	frame.stackSlot = vm.stackSize() - argCount - 1
 	return true
 }
 
+func (vm *VM) captureUpvalue(location int) *chunk.ObjUpvalue {
+	var prev *chunk.ObjUpvalue
+	upvalue := vm.openUpvalues
+	for upvalue != nil && upvalue.Location > location {
+		prev = upvalue
+		upvalue = upvalue.Next
+	}
+
+	if upvalue != nil && upvalue.Location == location {
+		return upvalue
+	}
+
+	created := vm.heap.Allocate(chunk.NewUpvalue(location)).AsUpvalue()
+	created.Next = upvalue
+	if prev == nil {
+		vm.openUpvalues = created
+	} else {
+		prev.Next = created
+	}
+	return created
+}
+
+func (vm *VM) closeUpvalues(last int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.Location >= last {
+		upvalue := vm.openUpvalues
+		upvalue.Closed = vm.stack[upvalue.Location]
+		upvalue.Location = -1
+		vm.openUpvalues = upvalue.Next
+	}
+}
+
 func (vm *VM) popBinaryNumber() (float64, float64, bool) {
 	if !vm.stackPeek(0).IsNumber() || !vm.stackPeek(1).IsNumber() {
 		vm.runtimeError("Operands must be numbers.")
@@ -252,56 +716,178 @@ func (vm *VM) popBinaryNumber() (float64, float64, bool) {
 	return a, b, true
 }
 
-func (vm *VM) popBinaryString() (string, string, bool) {
-	if !vm.stackPeek(0).IsString() || !vm.stackPeek(1).IsString() {
-		vm.runtimeError("Operands must be strings.")
-		return "", "", false
+func (vm *VM) popBinaryInteger() (int64, int64, bool) {
+	a, ok := chunk.ToInteger(vm.stackPeek(1))
+	b, ok2 := chunk.ToInteger(vm.stackPeek(0))
+	if !ok || !ok2 {
+		vm.runtimeError("Operands must be integers.")
+		return 0, 0, false
 	}
-	b := vm.stackPop().AsString()
-	a := vm.stackPop().AsString()
+	vm.stackPop()
+	vm.stackPop()
 	return a, b, true
 }
 
+// popShift pops the operands of a shift, whose count must be in the uint32
+// range.
+func (vm *VM) popShift() (int64, uint32, bool) {
+	a, ok := chunk.ToInteger(vm.stackPeek(1))
+	b, ok2 := chunk.ToInteger(vm.stackPeek(0))
+	if !ok || !ok2 || !chunk.IsShiftCount(b) {
+		vm.runtimeError("Operands must be integers.")
+		return 0, 0, false
+	}
+	vm.stackPop()
+	vm.stackPop()
+	return a, uint32(b), true
+}
+
+// pushNumber pushes the result of an arithmetic instruction, which must not
+// be NaN in strict mode.
+func (vm *VM) pushNumber(n float64) bool {
+	if vm.numbers == NUMBER_STRICT && math.IsNaN(n) {
+		vm.runtimeError("Result is not a number.")
+		return false
+	}
+	vm.stackPush(chunk.NewNumber(n))
+	return true
+}
+
+// checkDivisor reports message as a runtime error if b is zero in strict
+// mode.
+func (vm *VM) checkDivisor(b float64, message string) bool {
+	if vm.numbers == NUMBER_STRICT && b == 0 {
+		vm.runtimeError("%s", message)
+		return false
+	}
+	return true
+}
+
 func (vm *VM) readByte() byte {
-	bt := vm.frames[vm.frameCount-1].function.Ck.Codes[vm.frames[vm.frameCount-1].ip]
+	bt := vm.frames[vm.frameCount-1].closure.Function.Ck.Codes[vm.frames[vm.frameCount-1].ip]
 	vm.frames[vm.frameCount-1].ip++
 	return bt
 }
 
 func (vm *VM) readShort() uint16 {
-	bt1 := uint16(vm.frames[vm.frameCount-1].function.Ck.Codes[vm.frames[vm.frameCount-1].ip])
+	bt1 := uint16(vm.frames[vm.frameCount-1].closure.Function.Ck.Codes[vm.frames[vm.frameCount-1].ip])
 	vm.frames[vm.frameCount-1].ip++
-	bt2 := uint16(vm.frames[vm.frameCount-1].function.Ck.Codes[vm.frames[vm.frameCount-1].ip])
+	bt2 := uint16(vm.frames[vm.frameCount-1].closure.Function.Ck.Codes[vm.frames[vm.frameCount-1].ip])
 	vm.frames[vm.frameCount-1].ip++
 	return (bt1 << 8) | bt2
 }
 
 func (vm *VM) readConstant() chunk.Value {
-	return vm.frames[vm.frameCount-1].function.Ck.Constants[vm.readByte()]
+	return vm.frames[vm.frameCount-1].closure.Function.Ck.Constants[vm.readByte()]
+}
+
+func (vm *VM) readConstantLong() chunk.Value {
+	idx := int(vm.readByte()) << 16
+	idx |= int(vm.readShort())
+	return vm.frames[vm.frameCount-1].closure.Function.Ck.Constants[idx]
+}
+
+// readConstantOperand reads a constant operand, in its long form if long is
+// set.
+func (vm *VM) readConstantOperand(long bool) chunk.Value {
+	if long {
+		return vm.readConstantLong()
+	}
+	return vm.readConstant()
+}
+
+// readName reads the constant operand naming a global, class, property or
+// method.
+func (vm *VM) readName(long bool) *chunk.ObjString {
+	return vm.readConstantOperand(long).AsString()
 }
 
 func (vm *VM) runtimeError(format string, a ...interface{}) {
-	utils.PrintfErr(format+"\n", a...)
+	err := &RuntimeError{Message: fmt.Sprintf(format, a...)}
 
 	for i := vm.frameCount - 1; i >= 0; i-- {
 		frame := &vm.frames[i]
-		fun := frame.function
-		utils.PrintfErr("[line %d] in ", fun.Ck.Lines[frame.ip-1])
-
-		if fun.Name == "" {
-			utils.PrintfErr("script\n")
-		} else {
-			utils.PrintfErr("%s()\n", fun.Name)
+		fun := frame.closure.Function
+		var pos chunk.Position
+		if frame.ip > 0 {
+			pos = fun.Ck.GetPosition(frame.ip - 1)
 		}
+		err.StackTrace = append(err.StackTrace, TraceFrame{Function: fun.Name, Line: pos.Line, Column: pos.Column})
+	}
+
+	if len(err.StackTrace) > 0 {
+		err.Line = err.StackTrace[0].Line
+		err.Column = err.StackTrace[0].Column
+		err.Function = err.StackTrace[0].Function
+		err.SourceLine, _ = utils.SourceLine(vm.source, err.Line)
 	}
 
+	vm.err = err
 	vm.stackReset()
 }
 
-func (vm *VM) defineNative(name string, native chunk.NativeFunction) {
-	vm.globals[name] = chunk.NewObject(chunk.NewNative(native))
+// DefineNative binds a Go function to the global name. The vm checks that
+// calls pass exactly arity arguments unless arity is chunk.VARIADIC. It
+// returns a chunk.OutOfMemory error if the heap limit leaves no room for the
+// native.
+func (vm *VM) DefineNative(name string, arity int, native chunk.NativeFunction) error {
+	top := vm.stackTop
+	err := catchOutOfMemory(func() {
+		// Keep both objects on the stack while allocating so neither is swept.
+		vm.stackPush(chunk.NewObject(&vm.heap.InternString(name).Object))
+		vm.stackPush(chunk.NewObject(vm.heap.Allocate(chunk.NewNative(name, arity, native))))
+		vm.globals.Set(vm.stackPeek(1).AsString(), vm.stackPeek(0))
+	})
+	vm.stackTop = top
+	return err
 }
 
-func clockNative(args ...chunk.Value) chunk.Value {
-	return chunk.NewNumber(float64(time.Now().Unix()))
+// catchOutOfMemory runs f, which allocates outside Run, and returns the
+// chunk.OutOfMemory it panics with, if any.
+func catchOutOfMemory(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			oom, ok := r.(chunk.OutOfMemory)
+			if !ok {
+				panic(r)
+			}
+			err = oom
+		}
+	}()
+	f()
+	return nil
+}
+
+func (vm *VM) markRoots(hp *chunk.Heap) {
+	for i := 0; i < vm.stackSize(); i++ {
+		hp.MarkValue(vm.stack[i])
+	}
+	for i := 0; i < vm.frameCount; i++ {
+		hp.MarkObject(&vm.frames[i].closure.Object)
+	}
+	for upvalue := vm.openUpvalues; upvalue != nil; upvalue = upvalue.Next {
+		hp.MarkObject(&upvalue.Object)
+	}
+	hp.MarkTable(&vm.globals)
+	if vm.initString != nil {
+		hp.MarkObject(&vm.initString.Object)
+	}
+}
+
+func clockNative(args ...chunk.Value) (chunk.Value, error) {
+	return chunk.NewNumber(float64(time.Now().Unix())), nil
+}
+
+func isNaNNative(args ...chunk.Value) (chunk.Value, error) {
+	if !args[0].IsNumber() {
+		return chunk.Nil, errors.New("Argument must be a number.")
+	}
+	return chunk.NewBool(math.IsNaN(args[0].AsNumber())), nil
+}
+
+func isInfiniteNative(args ...chunk.Value) (chunk.Value, error) {
+	if !args[0].IsNumber() {
+		return chunk.Nil, errors.New("Argument must be a number.")
+	}
+	return chunk.NewBool(math.IsInf(args[0].AsNumber(), 0)), nil
 }
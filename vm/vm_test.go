@@ -0,0 +1,685 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Roderland/glox-vm/chunk"
+	"github.com/Roderland/glox-vm/compiler"
+)
+
+func BenchmarkFib(b *testing.B) {
+	source := []byte(`
+fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 2) + fib(n - 1);
+}
+fib(35);
+`)
+	vm := New(Options{})
+	function, errs := compiler.Compile(source, vm.Heap(), false)
+	if errs != nil {
+		b.Fatal(errs)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := vm.Execute(function); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// defineReport gives vm a report(value) native and returns where the
+// reported values are collected.
+func defineReport(vm *VM) *[]string {
+	reported := &[]string{}
+	vm.DefineNative("report", 1, func(args ...chunk.Value) (chunk.Value, error) {
+		*reported = append(*reported, args[0].String())
+		return chunk.Nil, nil
+	})
+	return reported
+}
+
+// runReporting interprets source on a new VM and returns what it reported.
+func runReporting(t *testing.T, opts Options, source string) []string {
+	t.Helper()
+	vm := New(opts)
+	reported := defineReport(vm)
+	if _, err := vm.Interpret([]byte(source)); err != nil {
+		t.Fatalf("%s: %v", source, err)
+	}
+	return *reported
+}
+
+func TestStackUnderflow(t *testing.T) {
+	vm := New(Options{})
+	function := &chunk.ObjFunction{}
+	function.Ck.Write(chunk.OP_POP, chunk.Position{Line: 1})
+	function.Ck.Write(chunk.OP_POP, chunk.Position{Line: 1})
+	function.Ck.Write(chunk.OP_RETURN, chunk.Position{Line: 1})
+	vm.Heap().Allocate(chunk.NewFunction(function))
+
+	// Execute turns the code away before it runs.
+	result, err := vm.Execute(function)
+	var verifyErr *chunk.VerifyError
+	if result != RUNTIME_ERROR || !errors.As(err, &verifyErr) {
+		t.Fatalf("expected a verify error, got %v %v", result, err)
+	}
+
+	// Unverified code is still caught by the stack guard.
+	result, err = vm.execute(function)
+	var runtimeErr *RuntimeError
+	if result != RUNTIME_ERROR || !errors.As(err, &runtimeErr) || runtimeErr.Message != "Stack underflow." {
+		t.Fatalf("expected a stack underflow, got %v %v", result, err)
+	}
+}
+
+// TestVerifiedCodeFails runs code that passes chunk.Verify but misuses
+// values, which must end in a runtime error rather than a Go panic.
+func TestVerifiedCodeFails(t *testing.T) {
+	for _, tc := range []struct {
+		codes   []byte
+		message string
+	}{
+		{[]byte{chunk.OP_NIL, chunk.OP_NIL, chunk.OP_METHOD, 0, chunk.OP_RETURN}, "Methods can only be defined on classes."},
+		{[]byte{chunk.OP_NIL, chunk.OP_NIL, chunk.OP_GET_SUPER, 0, chunk.OP_RETURN}, "Superclass must be a class."},
+		{[]byte{chunk.OP_NIL, chunk.OP_NIL, chunk.OP_SUPER_INVOKE, 0, 0, chunk.OP_RETURN}, "Superclass must be a class."},
+		{[]byte{chunk.OP_CLASS, 0, chunk.OP_NIL, chunk.OP_INHERIT, chunk.OP_RETURN}, "Subclass must be a class."},
+		{[]byte{chunk.OP_CLASS, 0, chunk.OP_NIL, chunk.OP_METHOD, 0, chunk.OP_CALL, 0, chunk.OP_RETURN}, "Methods must be functions."},
+	} {
+		vm := New(Options{})
+		function := &chunk.ObjFunction{}
+		for _, code := range tc.codes {
+			function.Ck.Write(code, chunk.Position{Line: 1})
+		}
+		function.Ck.Constants = []chunk.Value{chunk.NewObject(&vm.Heap().InternString("init").Object)}
+		vm.Heap().Allocate(chunk.NewFunction(function))
+
+		_, err := vm.Execute(function)
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Message != tc.message {
+			t.Errorf("%v: got %v, want %q", tc.codes, err, tc.message)
+		}
+	}
+
+	vm := New(Options{})
+	function := &chunk.ObjFunction{UpvalueCount: 1}
+	function.Ck.Write(chunk.OP_GET_UPVALUE, chunk.Position{Line: 1})
+	function.Ck.Write(0, chunk.Position{Line: 1})
+	function.Ck.Write(chunk.OP_RETURN, chunk.Position{Line: 1})
+	vm.Heap().Allocate(chunk.NewFunction(function))
+	var verifyErr *chunk.VerifyError
+	if _, err := vm.Execute(function); !errors.As(err, &verifyErr) {
+		t.Errorf("script with an upvalue: got %v, want a verify error", err)
+	}
+}
+
+// TestMutatedBytecode decodes and runs randomly corrupted .loxc data. Every
+// mutant must either be rejected or run to a result without an internal
+// error, which is what Execute promises for code that passes Verify.
+func TestMutatedBytecode(t *testing.T) {
+	source := []byte(`
+class A { init(n) { this.n = n; } get() { return this.n; } }
+class B < A { get() { return super.get() * 2; } }
+fun adder(x) { fun add(y) { return x + y; } return add; }
+var b = B(3);
+if (b.get() > 1 and !nil) print adder(b.n)(1.5); else print "no";
+var s = "a" + "b";
+print s == "ab" or -1;
+`)
+	function, errs := compiler.Compile(source, chunk.NewHeap(), false)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	data, err := chunk.Encode(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		mutant := append([]byte(nil), data...)
+		for n := rnd.Intn(3) + 1; n > 0; n-- {
+			mutant[rnd.Intn(len(mutant))] = byte(rnd.Intn(256))
+		}
+
+		vm := New(Options{MaxHeapBytes: 1 << 20, Output: ioutil.Discard})
+		loaded, err := chunk.Decode(mutant, vm.Heap())
+		// Backward jumps can turn into loops that never end.
+		if err != nil || mayLoop(loaded) {
+			continue
+		}
+		_, err = vm.Execute(loaded)
+		var runtimeErr *RuntimeError
+		if errors.As(err, &runtimeErr) && strings.HasPrefix(runtimeErr.Message, "Internal error") {
+			t.Fatalf("%x: %v", mutant, err)
+		}
+	}
+}
+
+// mayLoop reports whether function or any function nested in it contains a
+// byte that could be OP_LOOP.
+func mayLoop(function *chunk.ObjFunction) bool {
+	for _, code := range function.Ck.Codes {
+		if code == chunk.OP_LOOP {
+			return true
+		}
+	}
+	for _, constant := range function.Ck.Constants {
+		if constant.IsObject() && constant.AsObject().IsFunction() && mayLoop(constant.AsObject().AsFunction()) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMaxFrames(t *testing.T) {
+	source := []byte(`
+fun depth(n) {
+  if (n == 0) return 0;
+  return 1 + depth(n - 1);
+}
+depth(100);
+`)
+	for _, tc := range []struct {
+		maxFrames int
+		ok        bool
+	}{
+		{DEFAULT_MAX_FRAME, false},
+		{200, true},
+	} {
+		vm := New(Options{MaxFrames: tc.maxFrames})
+		_, err := vm.Interpret(source)
+		if got := err == nil; got != tc.ok {
+			t.Errorf("MaxFrames %d: expected success %v, got error %v", tc.maxFrames, tc.ok, err)
+		}
+	}
+}
+
+func TestStackGrowth(t *testing.T) {
+	// A generous frame limit must not allocate the whole stack up front.
+	vm := New(Options{MaxFrames: 100000})
+	if len(vm.stack) > FRAME_STACK_SLOTS {
+		t.Fatalf("New allocated %d stack slots", len(vm.stack))
+	}
+
+	source := `
+fun depth(n) {
+  if (n == 0) return 0;
+  return 1 + depth(n - 1);
+}
+report(depth(5000));
+`
+	reported := defineReport(vm)
+	if _, err := vm.Interpret([]byte(source)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reported) != 1 || (*reported)[0] != "5000" {
+		t.Errorf("reported %v, want [5000]", *reported)
+	}
+
+	// MaxStack still bounds how far the stack grows.
+	vm = New(Options{MaxFrames: 100000, MaxStack: 1000})
+	defineReport(vm)
+	_, err := vm.Interpret([]byte(source))
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Message != "Stack overflow." {
+		t.Errorf("MaxStack 1000: got %v, want a stack overflow", err)
+	}
+}
+
+func TestInterpretErrors(t *testing.T) {
+	vm := New(Options{})
+
+	result, err := vm.Interpret([]byte("var a = 1;\nprint a +;"))
+	compileErr, ok := err.(*CompileError)
+	if result != COMPILE_ERROR || !ok {
+		t.Fatalf("expected a compile error, got %v %v", result, err)
+	}
+	if len(compileErr.Diagnostics) != 1 || compileErr.Diagnostics[0].Line != 2 {
+		t.Errorf("unexpected compile errors: %v", compileErr.Diagnostics)
+	}
+
+	result, err = vm.Interpret([]byte("fun f() {\n  return -nil;\n}\nf();"))
+	runtimeErr, ok := err.(*RuntimeError)
+	if result != RUNTIME_ERROR || !ok {
+		t.Fatalf("expected a runtime error, got %v %v", result, err)
+	}
+	if runtimeErr.Line != 2 || runtimeErr.Function != "f" || len(runtimeErr.StackTrace) != 2 {
+		t.Errorf("unexpected runtime error: %+v", runtimeErr)
+	}
+	if runtimeErr.Column != 10 || runtimeErr.SourceLine != "  return -nil;" {
+		t.Errorf("runtime error points at the wrong place: %+v", runtimeErr)
+	}
+
+	// Globals survive between calls on the same VM.
+	if _, err := vm.Interpret([]byte("var kept = 1;")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Interpret([]byte("kept = kept + 1;")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefineNative(t *testing.T) {
+	vm := New(Options{})
+	vm.DefineNative("sum", chunk.VARIADIC, func(args ...chunk.Value) (chunk.Value, error) {
+		total := 0.0
+		for _, arg := range args {
+			if !arg.IsNumber() {
+				return chunk.Nil, errors.New("sum() takes numbers.")
+			}
+			total += arg.AsNumber()
+		}
+		return chunk.NewNumber(total), nil
+	})
+	vm.DefineNative("one", 1, func(args ...chunk.Value) (chunk.Value, error) {
+		return args[0], nil
+	})
+
+	if _, err := vm.Interpret([]byte(`if (sum(1, 2, 3) + sum() != 6) nope();`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for source, message := range map[string]string{
+		`one();`:             "Expected 1 arguments but got 0.",
+		`one(1, 2);`:         "Expected 1 arguments but got 2.",
+		"\n\nsum(1, \"a\");": "sum() takes numbers.",
+	} {
+		_, err := vm.Interpret([]byte(source))
+		runtimeErr, ok := err.(*RuntimeError)
+		if !ok || runtimeErr.Message != message {
+			t.Errorf("%s: expected %q, got %v", source, message, err)
+			continue
+		}
+		if len(runtimeErr.StackTrace) != 1 {
+			t.Errorf("%s: expected a stack trace, got %+v", source, runtimeErr.StackTrace)
+		}
+	}
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	source := []byte(`
+fun inc(x) { return x + 1; }
+class Greeter {
+  init(name) { this.name = name; }
+  greet() { return "hello " + this.name; }
+}
+fun twice(f) { fun g(x) { return f(f(x)); } return g; }
+report(Greeter("lox").greet());
+report(twice(inc)(1.5));
+`)
+
+	function, errs := compiler.Compile(source, chunk.NewHeap(), false)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	data, err := chunk.Encode(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := New(Options{StressGC: true})
+	reported := defineReport(vm)
+	loaded, err := chunk.Decode(data, vm.Heap())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.Execute(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(*reported, ","); got != "hello lox,3.5" {
+		t.Errorf("unexpected output %s", got)
+	}
+
+	for _, bad := range [][]byte{data[:len(data)-1], append(data[:len(data):len(data)], 0), []byte("print 1;")} {
+		var decodeErr *chunk.DecodeError
+		if _, err := chunk.Decode(bad, vm.Heap()); !errors.As(err, &decodeErr) {
+			t.Errorf("expected a decode error, got %v", err)
+		}
+	}
+}
+
+func TestWideConstants(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("var total = 0;\n")
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&sb, "var g%d = %d.5;\ntotal = total + g%d;\n", i, i, i)
+	}
+	// Everything below needs constant indexes beyond 255.
+	sb.WriteString(`
+fun h() { return 1; }
+class Base { get() { return this.f399; } }
+class Config < Base {
+  init() { this.f399 = 0.5; }
+  get() { var get = super.get; return super.get() + get(); }
+}
+var c = Config();
+c.f399 = c.f399 + h();
+report(total + c.get());
+`)
+
+	want := fmt.Sprint(400*399/2 + 200 + 3)
+	if got := runReporting(t, Options{}, sb.String()); len(got) != 1 || got[0] != want {
+		t.Errorf("unexpected total %v, want %s", got, want)
+	}
+}
+
+func TestClosures(t *testing.T) {
+	source := `
+fun makeCounter() {
+  var count = 0;
+  fun counter() {
+    count = count + 1;
+    return count;
+  }
+  return counter;
+}
+var counter = makeCounter();
+counter();
+report(counter());
+
+var get;
+var set;
+fun pair() {
+  var shared = "before";
+  fun g() { return shared; }
+  fun s(value) { shared = value; }
+  get = g;
+  set = s;
+}
+pair();
+set("after");
+report(get());
+
+var first;
+var second;
+for (var i = 0; i < 2; i = i + 1) {
+  var captured = i * 10;
+  fun f() { return captured; }
+  if (first == nil) first = f; else second = f;
+}
+report(first());
+report(second());
+`
+	got := strings.Join(runReporting(t, Options{StressGC: true}, source), ",")
+	if got != "2,after,0,10" {
+		t.Errorf("printed %s, want 2,after,0,10", got)
+	}
+}
+
+func TestClasses(t *testing.T) {
+	source := `
+class Point {
+  init(x, y) {
+    this.x = x;
+    this.y = y;
+  }
+  sum() { return this.x + this.y; }
+  name() { return "method"; }
+}
+var p = Point(1, 2);
+var sum = p.sum;
+p.x = 10;
+report(sum());
+
+fun field() { return "field"; }
+p.name = field;
+report(p.name());
+report(Point(0, 0).name());
+`
+	got := strings.Join(runReporting(t, Options{StressGC: true}, source), ",")
+	if got != "12,field,method" {
+		t.Errorf("printed %s, want 12,field,method", got)
+	}
+
+	errs := map[string]string{
+		"class A { init(a) {} } A();":    "Expected 1 arguments but got 0.",
+		"class A { init() {} } A(1, 2);": "Expected 0 arguments but got 2.",
+		"class A {} A(1);":               "Expected 0 arguments but got 1.",
+		"class A {} print A().missing;":  "Undefined property 'missing'.",
+		"var a = 1; print a.field;":      "Only instances have properties.",
+	}
+	for source, message := range errs {
+		_, err := New(Options{}).Interpret([]byte(source))
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Message != message {
+			t.Errorf("%s: got %v, want %q", source, err, message)
+		}
+	}
+}
+
+func TestInheritance(t *testing.T) {
+	source := `
+class A {
+  name() { return "A"; }
+  describe() { return "A.describe"; }
+}
+class B < A {
+  name() { return "B>" + super.name(); }
+}
+class C < B {
+  name() {
+    var method = super.name;
+    return "C>" + method();
+  }
+}
+var c = C();
+report(c.name());
+report(c.describe());
+`
+	got := strings.Join(runReporting(t, Options{StressGC: true}, source), ",")
+	if got != "C>B>A,A.describe" {
+		t.Errorf("printed %s, want C>B>A,A.describe", got)
+	}
+
+	for _, source := range []string{"var A = 1; class B < A {}", "fun A() {} class B < A {}"} {
+		_, err := New(Options{}).Interpret([]byte(source))
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Message != "Superclass must be a class." {
+			t.Errorf("%s: got %v, want a superclass error", source, err)
+		}
+	}
+}
+
+func TestStringInterning(t *testing.T) {
+	// Strings built at run time must equal literals and find globals by name.
+	source := `
+var a = "glo";
+var joined = a + "x";
+report(joined == "glox");
+report(joined != "glo" + "x");
+var glox = "global";
+fun lookup() { return glox; }
+report(lookup());
+`
+	got := strings.Join(runReporting(t, Options{StressGC: true}, source), ",")
+	if got != "true,false,global" {
+		t.Errorf("printed %s, want true,false,global", got)
+	}
+}
+
+func TestOptimizeKeepsBehaviour(t *testing.T) {
+	source := `
+fun classify(n) {
+  if (n != n) return "nan";
+  if (n >= 10) { return "big"; } else if (n <= 0) { return "small"; }
+  return "medium";
+  report("unreachable");
+}
+var nan = 0 / 0;
+report(classify(nan));
+for (var i = -1; i < 12; i = i + 4) {
+  if (i == 3) report("three"); else report(classify(i));
+}
+var n = 0;
+while (!(n >= 3)) { n = n + 1; if (n > 100) report("runaway"); }
+report(n);
+report(nan >= 1);
+report(nan <= 1);
+report(true and false or "or");
+`
+
+	outputs := make([][]string, 2)
+	for i, optimize := range []bool{false, true} {
+		outputs[i] = runReporting(t, Options{Optimize: optimize}, source)
+
+		c := compiler.New(chunk.NewHeap(), false)
+		c.SetOptimize(optimize)
+		function, errs := c.Compile([]byte(source))
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		if err := chunk.Verify(function); err != nil {
+			t.Errorf("optimize %v: %v", optimize, err)
+		}
+	}
+
+	if strings.Join(outputs[0], ",") != strings.Join(outputs[1], ",") {
+		t.Errorf("optimized code printed %v, want %v", outputs[1], outputs[0])
+	}
+}
+
+func TestBreakContinue(t *testing.T) {
+	source := `
+for (var i = 0; i < 10; i = i + 1) {
+  var sq = i * i;
+  if (i == 2) continue;
+  if (sq > 20) break;
+  report(sq);
+}
+var n = 0;
+var last;
+while (true) {
+  var k = n;
+  fun get() { return k; }
+  last = get;
+  n = n + 1;
+  if (n < 3) continue;
+  break;
+}
+report(last());
+`
+	if got := strings.Join(runReporting(t, Options{}, source), ","); got != "0,1,9,16,2" {
+		t.Errorf("printed %s, want 0,1,9,16,2", got)
+	}
+
+	for _, source := range []string{"break;", "fun f() { while (true) { fun g() { continue; } } }"} {
+		_, err := New(Options{}).Interpret([]byte(source))
+		var compileErr *CompileError
+		if !errors.As(err, &compileErr) || !strings.Contains(err.Error(), "outside of a loop") {
+			t.Errorf("%q: got %v, want a compile error", source, err)
+		}
+	}
+}
+
+func TestArithmeticOperators(t *testing.T) {
+	tests := map[string]string{
+		"7 % 3":          "1",
+		"-7 % 3":         "2",
+		"7 % -3":         "-2",
+		"-7 % -3":        "-1",
+		"15 / 2 % 2":     "1.5",
+		"7 % 0":          "NaN",
+		"7 ~/ 2":         "3",
+		"-7 ~/ 2":        "-4",
+		"7 ~/ 0":         "+Inf",
+		"0 ~/ 0":         "NaN",
+		"2 ** 3 ** 2":    "512",
+		"-2 ** 2":        "-4",
+		"(-2) ** 2":      "4",
+		"2 ** -1":        "0.5",
+		"1 + 2 ** 2 * 3": "13",
+		"2 * 3 % 4":      "2",
+	}
+	for expr, want := range tests {
+		// Run each expression both folded at compile time and at run time
+		// through variables.
+		vars := strings.NewReplacer("7", "seven", "2", "two").Replace(expr)
+		for _, source := range []string{"report(" + expr + ");", "var seven = 7; var two = 2; report(" + vars + ");"} {
+			if got := runReporting(t, Options{}, source); len(got) != 1 || got[0] != want {
+				t.Errorf("%s printed %v, want %s", source, got, want)
+			}
+		}
+	}
+}
+
+func TestNumberModes(t *testing.T) {
+	strictErrors := map[string]string{
+		"print 1 / 0;":                          "Division by zero.",
+		"print 1 % 0;":                          "Modulo by zero.",
+		"print 0 ~/ 0;":                         "Division by zero.",
+		"print (-8) ** 0.5;":                    "Result is not a number.",
+		"var inf = 10 ** 400; print inf - inf;": "Result is not a number.",
+	}
+	for source, message := range strictErrors {
+		_, err := New(Options{}).Interpret([]byte(source))
+		if err != nil {
+			t.Errorf("%q failed in IEEE mode: %v", source, err)
+		}
+
+		_, err = New(Options{Numbers: NUMBER_STRICT}).Interpret([]byte(source))
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Message != message {
+			t.Errorf("%q in strict mode: got %v, want %q", source, err, message)
+		}
+	}
+
+	source := `report(isNaN(0 / 0)); report(isNaN(1)); report(isInfinite(-1 / 0)); report(isInfinite(0 / 0));`
+	if got := strings.Join(runReporting(t, Options{}, source), ","); got != "true,false,true,false" {
+		t.Errorf("printed %s, want true,false,true,false", got)
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	tests := map[string]string{
+		"a & b":      "8",
+		"a | b":      "14",
+		"a ^ b":      "6",
+		"~a":         "-13",
+		"a << 2":     "48",
+		"-a >> 1":    "-6",
+		"a >> 64":    "0",
+		"a & 1 == 0": "true",
+		"1 + 2 << 1": "6",
+		"12 & 10":    "8",
+	}
+	for expr, want := range tests {
+		source := "var a = 12; var b = 10; report(" + expr + ");"
+		if got := runReporting(t, Options{}, source); len(got) != 1 || got[0] != want {
+			t.Errorf("%s printed %v, want %s", expr, got, want)
+		}
+	}
+
+	for _, expr := range []string{"a & 1.5", "a << -1", "a | \"x\"", "nil >> a", "a ^ 9223372036854775808", "~0.5"} {
+		_, err := New(Options{}).Interpret([]byte("var a = 12; print " + expr + ";"))
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Message != "Operands must be integers." && runtimeErr.Message != "Operand must be an integer." {
+			t.Errorf("%s: got %v, want an integer error", expr, err)
+		}
+	}
+}
+
+func TestMaxHeapBytes(t *testing.T) {
+	// A limit below what New itself needs must not panic.
+	vm := New(Options{MaxHeapBytes: 100})
+	var oom chunk.OutOfMemory
+	if err := vm.DefineNative("more", 0, clockNative); !errors.As(err, &oom) {
+		t.Errorf("DefineNative: got %v, want out of memory", err)
+	}
+	if _, err := vm.Interpret([]byte(`print "a" + "b";`)); err == nil {
+		t.Error("Interpret: expected an error")
+	}
+
+	vm = New(Options{MaxHeapBytes: 4096})
+	_, err := vm.Interpret([]byte(`var s = ""; while (true) s = s + "grow";`))
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) || runtimeErr.Message != "Out of memory." {
+		t.Errorf("got %v, want a runtime out of memory error", err)
+	}
+}